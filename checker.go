@@ -0,0 +1,646 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/LondonTrustMedia/downtime_alert/lib"
+	"github.com/LondonTrustMedia/downtime_alert/lib/slo"
+	"github.com/tidwall/buntdb"
+)
+
+// Minimum samples needed before SLOs are evaluated, for SLOs that don't set min-samples.
+const (
+	defaultUptimeMinSamples   = 3
+	defaultDownloadMinSamples = 3
+	defaultRTTMinSamples      = 16
+)
+
+// Checker checks services, alerts on their failures and keeps track of their SLO trackers.
+// Checks can run concurrently, but recording their results and deciding whether to alert is
+// done one service at a time.
+type Checker struct {
+	ctx    context.Context
+	config *lib.Config
+	db     *buntdb.DB
+
+	// recordLock protects the trackers and serialises our ongoing downtime updates
+	recordLock sync.Mutex
+
+	// trackers are kept in memory and written to the datastore by Flush
+	downloadTrackers map[string]*slo.DownloadTracker
+	pingTrackers     map[string]*slo.PingTracker
+}
+
+// NewChecker returns a new Checker. Checks in progress are cancelled when ctx is done.
+func NewChecker(ctx context.Context, config *lib.Config, db *buntdb.DB) *Checker {
+	return &Checker{
+		ctx:              ctx,
+		config:           config,
+		db:               db,
+		downloadTrackers: make(map[string]*slo.DownloadTracker),
+		pingTrackers:     make(map[string]*slo.PingTracker),
+	}
+}
+
+// downloadTracker returns the given DownloadTracker, loading it from the datastore if we don't have it yet.
+func (c *Checker) downloadTracker(section, name string) *slo.DownloadTracker {
+	sloTrackerKey := fmt.Sprintf(keySloTracker, section, name)
+	tracker, exists := c.downloadTrackers[sloTrackerKey]
+	if !exists {
+		var err error
+		tracker, err = LoadDownloadTrackerFromDatastore(c.db, section, name)
+		if err != nil || tracker == nil {
+			tracker = slo.NewDownloadTracker()
+		}
+		c.downloadTrackers[sloTrackerKey] = tracker
+	}
+	return tracker
+}
+
+// pingTracker returns the given PingTracker, loading it from the datastore if we don't have it yet.
+func (c *Checker) pingTracker(section, name string) *slo.PingTracker {
+	sloTrackerKey := fmt.Sprintf(keySloTracker, section, name)
+	tracker, exists := c.pingTrackers[sloTrackerKey]
+	if !exists {
+		var err error
+		tracker, err = LoadPingTrackerFromDatastore(c.db, section, name)
+		if err != nil || tracker == nil {
+			tracker = slo.NewPingTracker()
+		}
+		c.pingTrackers[sloTrackerKey] = tracker
+	}
+	return tracker
+}
+
+// Flush writes all of our SLO trackers to the datastore.
+func (c *Checker) Flush() {
+	c.recordLock.Lock()
+	defer c.recordLock.Unlock()
+
+	err := c.db.Update(func(tx *buntdb.Tx) error {
+		for sloTrackerKey, tracker := range c.downloadTrackers {
+			_, _, err := tx.Set(sloTrackerKey, tracker.String(), nil)
+			if err != nil {
+				return err
+			}
+		}
+		for sloTrackerKey, tracker := range c.pingTrackers {
+			_, _, err := tx.Set(sloTrackerKey, tracker.String(), nil)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		log.Println("Couldn't save SLO trackers:", err.Error())
+	}
+}
+
+// CheckSocks5 checks the given SOCKS5 proxy and alerts if its SLOs aren't being met.
+func (c *Checker) CheckSocks5(name string, mconfig lib.Socks5Config) {
+	// get which set of creds to use
+	credsToUse := lib.GetCounter(c.db, fmt.Sprintf("socks5-%s-%d-credentials", mconfig.Host, mconfig.Port), len(mconfig.Credentials)-1)
+
+	// check! results go into their own tracker so we don't need to lock while checking
+	results := slo.NewDownloadTracker()
+	ctx, cancel := context.WithTimeout(c.ctx, mconfig.TimeoutDuration)
+	err := lib.CheckSocks5(ctx, results, mconfig, credsToUse)
+	cancel()
+	if lib.IsTimeout(err) {
+		results.AddTimeout(time.Now(), err.Error())
+		fmt.Println("SOCKS5 check timed out:", err.Error())
+	} else if lib.IsAuthFailure(err) {
+		results.AddAuthFailure(time.Now(), err.Error())
+		fmt.Println("SOCKS5 check failed authentication:", err.Error())
+	} else if lib.IsEgressFailure(err) {
+		results.AddEgressFailure(time.Now(), err.Error())
+		fmt.Println("SOCKS5 egress check failed:", err.Error())
+	} else if err != nil {
+		results.AddFailure(time.Now(), err.Error())
+		fmt.Println("SOCKS5 check failed:", err.Error())
+	}
+	if len(mconfig.Credentials) > 0 {
+		results.AttributeTo(mconfig.Credentials[credsToUse].Username)
+	}
+
+	c.recordDownloads("socks5", name, mconfig.Host, mconfig.Credentials, results, mconfig.TestDownload, mconfig.Tags, mconfig.Notify)
+}
+
+// CheckHTTPProxy checks the given HTTP proxy and alerts if its SLOs aren't being met.
+func (c *Checker) CheckHTTPProxy(name string, mconfig lib.HTTPProxyConfig) {
+	// get which set of creds to use
+	credsToUse := lib.GetCounter(c.db, fmt.Sprintf("http-proxy-%s-%d-credentials", mconfig.Host, mconfig.Port), len(mconfig.Credentials)-1)
+
+	// check! results go into their own tracker so we don't need to lock while checking
+	results := slo.NewDownloadTracker()
+	ctx, cancel := context.WithTimeout(c.ctx, mconfig.TimeoutDuration)
+	err := lib.CheckHTTPProxy(ctx, results, mconfig, credsToUse)
+	cancel()
+	if lib.IsTimeout(err) {
+		results.AddTimeout(time.Now(), err.Error())
+		fmt.Println("HTTP proxy check timed out:", err.Error())
+	} else if lib.IsAuthFailure(err) {
+		results.AddAuthFailure(time.Now(), err.Error())
+		fmt.Println("HTTP proxy check failed authentication:", err.Error())
+	} else if err != nil {
+		results.AddFailure(time.Now(), err.Error())
+		fmt.Println("HTTP proxy check failed:", err.Error())
+	}
+	if len(mconfig.Credentials) > 0 {
+		results.AttributeTo(mconfig.Credentials[credsToUse].Username)
+	}
+
+	c.recordDownloads("http-proxy", name, mconfig.Host, mconfig.Credentials, results, mconfig.TestDownload, mconfig.Tags, mconfig.Notify)
+}
+
+// recordDownloads adds the given test download results to the service's tracker, and alerts if its
+// SLOs aren't being met or any of its credentials keep being rejected.
+func (c *Checker) recordDownloads(section, name, host string, credentials []lib.UserPassCredentialConfig, results *slo.DownloadTracker, testDownload lib.TestDownloadConfig, tags []string, serviceNotify lib.ServiceNotifyConfig) {
+	c.recordLock.Lock()
+
+	// confirm that we have our SLO tracker
+	tracker := c.downloadTracker(section, name)
+	tracker.Merge(&results.Tracker)
+
+	// remove old history
+	tracker.CullHistory(time.Now().Add(testDownload.SLO.HistoryRetained * -1))
+	tracker.CullBuckets(time.Now().Add(testDownload.SLO.ErrorBudget.Retention(testDownload.SLO.HistoryRetained) * -1))
+
+	// check specific failures
+	//TODO(dan): Don't alert 3000 times for the same issue, implement failure pattern detection and hiding and all.
+	// We'll likely integrate this in as a "ShouldAlert" function into the tracker itself.
+	var alertMessage string
+	performanceGuard := testDownload.SLO.Guard(defaultDownloadMinSamples)
+	egressFailing, egressMessage := tracker.EgressFailing()
+	failCount, failMessages := tracker.ConsecutiveFailures()
+	if egressFailing {
+		// traffic leaking is alerted on straight away, and separately from normal failures
+		alertMessage = egressMessage
+	} else if failCount >= testDownload.SLO.MaxFailuresInARow {
+		alertMessage = fmt.Sprintf("Failed %d times in a row:\n%s", failCount, failMessages)
+	} else if message := burnRateAlert(&tracker.Tracker, testDownload.SLO.ErrorBudget); message != "" {
+		alertMessage = message
+	} else if !testDownload.SLO.ErrorBudget.Enabled() && !tracker.UptimeIsAbove(testDownload.SLO.UptimeTarget, testDownload.SLO.Guard(defaultUptimeMinSamples)) {
+		alertMessage = fmt.Sprintf("Uptime is lower than %f -- %d of %d tests timed out", testDownload.SLO.UptimeTarget, tracker.TimeoutsPerformed(), tracker.TotalTestsPerformed())
+	} else if !tracker.SpeedIsAbove(testDownload.SLO.MinBytesPerSecond, testDownload.SLO.SpeedTarget, performanceGuard) {
+		alertMessage = fmt.Sprintf("Proxy is very slow. Target of %s/s for %d%% of connections not met -- %s from %d tests", bytefmt.ByteSize(testDownload.SLO.MinBytesPerSecond), int(testDownload.SLO.SpeedTarget*100), tracker.SpeedPercentiles(), tracker.SuccessfulTestsPerformed())
+	} else if tracker.SuccessfulTestsPerformed() >= performanceGuard.MinSamples {
+		for _, target := range testDownload.SLO.SpeedPercentiles {
+			speed := tracker.SpeedPercentile(target.Percentile)
+			if speed < target.MinBytesPerSecond {
+				alertMessage = fmt.Sprintf("Proxy is very slow. Target of %s/s for p%v not met -- p%v is %s/s, %s from %d tests", bytefmt.ByteSize(target.MinBytesPerSecond), target.Percentile, target.Percentile, bytefmt.ByteSize(speed), tracker.SpeedPercentiles(), tracker.SuccessfulTestsPerformed())
+				break
+			}
+		}
+	}
+	if alertMessage == "" {
+		for _, target := range testDownload.SLO.PhaseTargets {
+			if !tracker.PhaseIsBelow(target.Phase, target.MaxTime, target.Target, performanceGuard) {
+				tests := tracker.PhaseTestsPerformed(target.Phase)
+				alertMessage = fmt.Sprintf("Phase %s is very slow. Target of %s for %d%% of connections not met -- average is %s from %d tests", target.Phase, target.MaxTime, int(target.Target*100), tracker.AveragePhase(target.Phase), tests)
+				break
+			}
+		}
+	}
+	if alertMessage == "" {
+		alertMessage = credentialAuthFailures(&tracker.Tracker, host, credentials, testDownload.SLO.MaxAuthFailuresInARow)
+	}
+
+	flap, downtime, alerted := c.recordState(section, name, alertMessage == "", nil)
+
+	c.recordLock.Unlock()
+
+	targets := c.config.Notify.TargetsFor(section, name, tags, serviceNotify)
+	if egressFailing {
+		// traffic leaking is alerted on even while the proxy is flapping
+		EgressFailAndNotify(c.config.Notify, targets, name, alertMessage)
+	} else {
+		c.notifyState(targets, name, flap, alerted, alertMessage, downtime)
+	}
+}
+
+// recordState marks the given service as up or down, and returns whether it's flapping, the downtime
+// that just ended if it's come back up, and whether to alert that it's down. shouldAlert decides
+// whether to alert for down services that aren't flapping, or if it's nil we always alert.
+// Must be called with recordLock held.
+func (c *Checker) recordState(section, name string, up bool, shouldAlert func() bool) (lib.FlapStatus, *lib.Downtime, bool) {
+	flap := lib.RecordFlapping(c.db, c.config.Ongoing.Flapping, section, name, up)
+	if up {
+		return flap, lib.MarkUp(c.db, section, name), false
+	}
+
+	lib.MarkDown(c.db, section, name)
+	if flap.Changed() {
+		// the flapping notification says that it's down, so counts as an alert
+		lib.MarkAlerted(c.db, section, name)
+		return flap, nil, false
+	}
+	if flap.Flapping() {
+		return flap, nil, false
+	}
+	if shouldAlert != nil {
+		return flap, nil, shouldAlert()
+	}
+	lib.MarkAlerted(c.db, section, name)
+	return flap, nil, true
+}
+
+// notifyState notifies the given targets that the service is down or back up, or that it's started
+// or stopped flapping. Individual up and down notifications aren't sent while it's flapping.
+func (c *Checker) notifyState(targets lib.NotifyTargetsConfig, name string, flap lib.FlapStatus, alerted bool, alertMessage string, downtime *lib.Downtime) {
+	if flap.Changed() {
+		FlapAndNotify(c.config.Notify, targets, name, flap, alertMessage)
+	} else if flap.Flapping() {
+		log.Println(name, "is flapping, not notifying")
+	} else if alerted {
+		FailAndNotify(c.config.Notify, targets, name, alertMessage)
+	} else {
+		RecoverAndNotify(c.config.Notify, targets, name, downtime)
+	}
+}
+
+// burnRateAlert returns an alert message if the tracker's error budget is being used up too quickly.
+func burnRateAlert[M any](tracker *slo.Tracker[M], budget lib.ErrorBudgetConfig) string {
+	if !budget.Enabled() {
+		return ""
+	}
+
+	now := time.Now()
+	alert := tracker.FiringBurnRate(now, budget.Target, budget.Rules)
+	if alert == nil {
+		return ""
+	}
+
+	remaining := tracker.RemainingErrorBudget(now, budget.PeriodDuration, budget.Target)
+	return fmt.Sprintf("Error budget is burning %.1fx over %s and %.1fx over %s, alerting at %.1fx -- %.1f%% of the %s error budget for %.2f%% uptime remains", alert.LongBurnRate, lib.FormatWindow(alert.Rule.LongWindow), alert.ShortBurnRate, lib.FormatWindow(alert.Rule.ShortWindow), alert.Rule.BurnRate, remaining*100, lib.FormatWindow(budget.PeriodDuration), budget.Target*100)
+}
+
+// credentialAuthFailures returns an alert message if any of the given credentials have been rejected
+// by the service too many times in a row.
+func credentialAuthFailures[M any](tracker *slo.Tracker[M], host string, credentials []lib.UserPassCredentialConfig, maxFailures int) string {
+	var messages []string
+	for _, creds := range credentials {
+		failCount, failMessage := tracker.CredentialAuthFailures(creds.Username)
+		if failCount >= maxFailures {
+			messages = append(messages, fmt.Sprintf("Credential %s failed auth %d times in a row on %s:\n%s", creds.Username, failCount, host, failMessage))
+		}
+	}
+
+	if len(messages) > 1 && len(messages) == len(credentials) {
+		return fmt.Sprintf("All credentials are failing auth on %s\n\n%s", host, strings.Join(messages, "\n\n"))
+	}
+	return strings.Join(messages, "\n\n")
+}
+
+// checkOngoing runs the given check and alerts via the ongoing downtime logic if it fails. The check is
+// retried once after a delay, to prevent notification on momentary net glitches.
+func (c *Checker) checkOngoing(section, name string, tags []string, serviceNotify lib.ServiceNotifyConfig, timeout time.Duration, check func(ctx context.Context) error, failMessage func(err error) string) {
+	checkOnce := func() error {
+		ctx, cancel := context.WithTimeout(c.ctx, timeout)
+		defer cancel()
+		return check(ctx)
+	}
+
+	// require two failures in a row to report it, to prevent notification on momentary net glitches
+	var failure bool
+
+	err := checkOnce()
+	if err != nil {
+		// wait for momentary net glitches to pass
+		time.Sleep(c.config.RecheckDelayDuration)
+		log.Printf("%s failed [%s], retrying", name, err.Error())
+		err = checkOnce()
+		if err != nil {
+			failure = true
+			log.Printf("%s failed again [%s]", name, err.Error())
+		}
+	}
+
+	c.recordLock.Lock()
+	flap, downtime, shouldAlert := c.recordState(section, name, !failure, func() bool {
+		return lib.ShouldAlertDowntime(c.db, c.config.Ongoing, section, name, 2)
+	})
+	c.recordLock.Unlock()
+
+	var alertMessage string
+	if failure {
+		alertMessage = failMessage(err)
+	}
+
+	targets := c.config.Notify.TargetsFor(section, name, tags, serviceNotify)
+	c.notifyState(targets, name, flap, shouldAlert, alertMessage, downtime)
+}
+
+// CheckWebpage checks the given web page and alerts if it's down.
+func (c *Checker) CheckWebpage(name string, mconfig lib.WebpageConfig) {
+	c.checkOngoing("webpage", name, mconfig.Tags, mconfig.Notify, mconfig.TimeoutDuration, func(ctx context.Context) error {
+		return lib.CheckWebpage(ctx, name, mconfig)
+	}, func(err error) string {
+		return fmt.Sprintf("URL: %s\nStatus: %s", mconfig.URL, err.Error())
+	})
+}
+
+// CheckJSONAPI checks the given JSON API endpoint and alerts if it's down.
+func (c *Checker) CheckJSONAPI(name string, mconfig lib.JSONAPIConfig) {
+	c.checkOngoing("json-api", name, mconfig.Tags, mconfig.Notify, mconfig.TimeoutDuration, func(ctx context.Context) error {
+		return lib.CheckJSONAPI(ctx, name, mconfig)
+	}, func(err error) string {
+		return fmt.Sprintf("URL: %s\nStatus: %s", mconfig.URL, err.Error())
+	})
+}
+
+// CheckTransaction runs the given transaction and alerts if it fails.
+func (c *Checker) CheckTransaction(name string, mconfig lib.TransactionConfig) {
+	c.checkOngoing("transaction", name, mconfig.Tags, mconfig.Notify, mconfig.TimeoutDuration, func(ctx context.Context) error {
+		return lib.CheckTransaction(ctx, name, mconfig)
+	}, func(err error) string {
+		return err.Error()
+	})
+}
+
+// CheckTLS checks the given TLS certificate, and alerts if it's invalid or close to expiring.
+func (c *Checker) CheckTLS(name string, mconfig lib.TLSConfig) {
+	ctx, cancel := context.WithTimeout(c.ctx, mconfig.TimeoutDuration)
+	info, err := lib.CheckTLS(ctx, name, mconfig)
+	cancel()
+	if err != nil {
+		log.Printf("%s failed [%s]", name, err.Error())
+	}
+
+	// find the most urgent warning threshold that we're under
+	var threshold time.Duration
+	var underThreshold bool
+	if err == nil {
+		for _, thresholdDuration := range mconfig.WarningThresholdsDurations {
+			if info.TimeUntilExpiry() < thresholdDuration {
+				threshold = thresholdDuration
+				underThreshold = true
+				break
+			}
+		}
+	}
+
+	c.recordLock.Lock()
+	flap, downtime, shouldAlert := c.recordState("tls", name, err == nil && !underThreshold, func() bool {
+		if err != nil {
+			return lib.ShouldAlertDowntime(c.db, c.config.Ongoing, "tls", name, 2)
+		}
+		// only alert once for each threshold we cross
+		return lib.ShouldAlertThreshold(c.db, "tls", name, threshold)
+	})
+	c.recordLock.Unlock()
+
+	var alertMessage string
+	if err != nil {
+		alertMessage = fmt.Sprintf("Host: %s:%d\nError: %s\n%s", mconfig.ServerName, mconfig.Port, err.Error(), lib.FormatTLSCertificateInfo(info))
+	} else if underThreshold {
+		alertMessage = fmt.Sprintf("Certificate expires in under %s\nHost: %s:%d\n%s", lib.FormatDays(threshold), mconfig.ServerName, mconfig.Port, lib.FormatTLSCertificateInfo(info))
+	}
+
+	targets := c.config.Notify.TargetsFor("tls", name, mconfig.Tags, mconfig.Notify)
+	if shouldAlert && err == nil {
+		WarnAndNotify(c.config.Notify, targets, name, alertMessage)
+	} else {
+		c.notifyState(targets, name, flap, shouldAlert, alertMessage, downtime)
+	}
+}
+
+// CheckPing pings the given host and alerts if its SLOs aren't being met.
+func (c *Checker) CheckPing(name string, mconfig lib.PingConfig) {
+	// check! results go into their own tracker so we don't need to lock while checking
+	results := slo.NewPingTracker()
+	ctx, cancel := context.WithTimeout(c.ctx, mconfig.TimeoutDuration)
+	err := lib.CheckPing(ctx, results, mconfig)
+	cancel()
+	if err != nil {
+		results.AddFailure(time.Now(), err.Error())
+		fmt.Println("PING check failed", err.Error())
+	}
+
+	c.recordLock.Lock()
+
+	// confirm that we have our SLO tracker
+	tracker := c.pingTracker("ping", name)
+	tracker.Merge(&results.Tracker)
+
+	// remove old history
+	tracker.CullHistory(time.Now().Add(mconfig.SLO.HistoryRetained * -1))
+	tracker.CullBuckets(time.Now().Add(mconfig.SLO.ErrorBudget.Retention(mconfig.SLO.HistoryRetained) * -1))
+
+	// check specific failures
+	//TODO(dan): Don't alert 3000 times for the same issue, implement failure pattern detection and hiding and all.
+	// We'll likely integrate this in as a "ShouldAlert" function into the tracker itself.
+	var alertMessage string
+	failCount, _ := tracker.ConsecutiveFailures()
+	if failCount >= mconfig.SLO.MaxFailuresInARow {
+		alertMessage = fmt.Sprintf("Failed %d times in a row", failCount)
+	} else if message := burnRateAlert(&tracker.Tracker, mconfig.SLO.ErrorBudget); message != "" {
+		alertMessage = message
+	} else if !mconfig.SLO.ErrorBudget.Enabled() && !tracker.UptimeIsAbove(mconfig.SLO.UptimeTarget, mconfig.SLO.Guard(defaultUptimeMinSamples)) {
+		alertMessage = fmt.Sprintf("Uptime is lower than %f -- %d of %d pings timed out", 100.0*mconfig.SLO.UptimeTarget, tracker.TimeoutsPerformed(), tracker.TotalTestsPerformed())
+	} else {
+		alertMessage = pingPerformanceAlert(tracker, mconfig)
+	}
+
+	flap, downtime, alerted := c.recordState("ping", name, alertMessage == "", nil)
+
+	c.recordLock.Unlock()
+
+	targets := c.config.Notify.TargetsFor("ping", name, mconfig.Tags, mconfig.Notify)
+	c.notifyState(targets, name, flap, alerted, alertMessage, downtime)
+}
+
+// pingPerformanceAlert returns an alert message if the host's RTT or jitter targets aren't being met.
+func pingPerformanceAlert(tracker *slo.PingTracker, mconfig lib.PingConfig) string {
+	guard := mconfig.SLO.Guard(defaultRTTMinSamples)
+	pings := tracker.SuccessfulTestsPerformed()
+	if !tracker.RTTIsBelow(mconfig.SLO.MaxRTT, mconfig.SLO.RTTTarget, guard) {
+		return fmt.Sprintf("Host is very slow. Target of %v for %d%% of pings not met -- %s from %d pings", mconfig.SLO.MaxRTT, int(mconfig.SLO.RTTTarget*100), tracker.RTTPercentiles(), pings)
+	}
+	if pings < guard.MinSamples {
+		return ""
+	}
+	for _, target := range mconfig.SLO.RTTPercentiles {
+		rtt := tracker.RTTPercentile(target.Percentile)
+		if target.MaxRTT < rtt {
+			return fmt.Sprintf("Host is very slow. Target of %v for p%v not met -- p%v is %v, %s from %d pings", target.MaxRTT, target.Percentile, target.Percentile, rtt, tracker.RTTPercentiles(), pings)
+		}
+	}
+	if 0 < mconfig.SLO.MaxJitter && mconfig.SLO.MaxJitter < tracker.Jitter() {
+		return fmt.Sprintf("Host has high jitter. Target of %v not met -- jitter is %v and RTT standard deviation is %v from %d pings", mconfig.SLO.MaxJitter, tracker.Jitter(), tracker.RTTStdDev(), pings)
+	}
+	return ""
+}
+
+// pingSLO is the SLO configuration of services whose checks are timed with a PingTracker, e.g.
+// how long a DNS query or handshake takes.
+type pingSLO struct {
+	HistoryRetained   time.Duration
+	MaxFailuresInARow int
+	UptimeTarget      float64
+	ErrorBudget       lib.ErrorBudgetConfig
+	lib.SampleGuardConfig
+	MaxRTT    time.Duration
+	RTTTarget float64
+	// MaxAuthFailuresInARow is how many times each credential can be rejected before we alert.
+	MaxAuthFailuresInARow int
+}
+
+// pingNouns describe a service and its checks in alerts.
+type pingNouns struct {
+	// Slow says that the service is slow, e.g. "Port is very slow to connect".
+	Slow string
+	// Tests is what each check is, e.g. "connections".
+	Tests string
+}
+
+// recordPingSLO adds the given check results to the service's tracker, and alerts if its SLOs aren't
+// being met or any of its credentials keep being rejected. host describes what was checked in failure
+// alerts, and err is the latest check's error.
+func (c *Checker) recordPingSLO(section, name, host string, credentials []lib.UserPassCredentialConfig, results *slo.PingTracker, sloConfig pingSLO, nouns pingNouns, tags []string, serviceNotify lib.ServiceNotifyConfig, err error) {
+	c.recordLock.Lock()
+
+	// confirm that we have our SLO tracker
+	tracker := c.pingTracker(section, name)
+	tracker.Merge(&results.Tracker)
+
+	// remove old history
+	tracker.CullHistory(time.Now().Add(sloConfig.HistoryRetained * -1))
+	tracker.CullBuckets(time.Now().Add(sloConfig.ErrorBudget.Retention(sloConfig.HistoryRetained) * -1))
+
+	var alertMessage string
+	failCount, _ := tracker.ConsecutiveFailures()
+	if failCount >= sloConfig.MaxFailuresInARow {
+		alertMessage = fmt.Sprintf("Failed %d times in a row\n%s\nError: %s", failCount, host, err)
+	} else if message := burnRateAlert(&tracker.Tracker, sloConfig.ErrorBudget); message != "" {
+		alertMessage = message
+	} else if !sloConfig.ErrorBudget.Enabled() && !tracker.UptimeIsAbove(sloConfig.UptimeTarget, sloConfig.Guard(defaultUptimeMinSamples)) {
+		alertMessage = fmt.Sprintf("Uptime is lower than %f -- %d of %d %s timed out", 100.0*sloConfig.UptimeTarget, tracker.TimeoutsPerformed(), tracker.TotalTestsPerformed(), nouns.Tests)
+	} else if !tracker.RTTIsBelow(sloConfig.MaxRTT, sloConfig.RTTTarget, sloConfig.Guard(defaultRTTMinSamples)) {
+		alertMessage = fmt.Sprintf("%s. Target of %v for %d%% of %s not met -- average is %v from %d tests", nouns.Slow, sloConfig.MaxRTT, int(sloConfig.RTTTarget*100), nouns.Tests, tracker.AverageRTT(), len(tracker.History))
+	} else {
+		alertMessage = credentialAuthFailures(&tracker.Tracker, name, credentials, sloConfig.MaxAuthFailuresInARow)
+	}
+
+	flap, downtime, alerted := c.recordState(section, name, alertMessage == "", nil)
+
+	c.recordLock.Unlock()
+
+	targets := c.config.Notify.TargetsFor(section, name, tags, serviceNotify)
+	c.notifyState(targets, name, flap, alerted, alertMessage, downtime)
+}
+
+// CheckDNS queries the given nameserver and alerts if its SLOs aren't being met.
+func (c *Checker) CheckDNS(name string, mconfig lib.DNSConfig) {
+	// check! results go into their own tracker so we don't need to lock while checking
+	results := slo.NewPingTracker()
+	ctx, cancel := context.WithTimeout(c.ctx, mconfig.TimeoutDuration)
+	err := lib.CheckDNS(ctx, results, mconfig)
+	cancel()
+	if err != nil {
+		fmt.Println("DNS check failed", err.Error())
+	}
+
+	c.recordPingSLO("dns", name, fmt.Sprintf("Query: %s %s\nNameserver: %s", mconfig.Type, mconfig.Query, mconfig.Nameserver), nil, results, pingSLO{
+		HistoryRetained:   mconfig.SLO.HistoryRetained,
+		MaxFailuresInARow: mconfig.SLO.MaxFailuresInARow,
+		UptimeTarget:      mconfig.SLO.UptimeTarget,
+		ErrorBudget:       mconfig.SLO.ErrorBudget,
+		SampleGuardConfig: mconfig.SLO.SampleGuardConfig,
+		MaxRTT:            mconfig.SLO.MaxLatency,
+		RTTTarget:         mconfig.SLO.LatencyTarget,
+	}, pingNouns{
+		Slow:  "Nameserver is very slow",
+		Tests: "queries",
+	}, mconfig.Tags, mconfig.Notify, err)
+}
+
+// CheckTCP connects to the given port and alerts if its SLOs aren't being met.
+func (c *Checker) CheckTCP(name string, mconfig lib.TCPConfig) {
+	// check! results go into their own tracker so we don't need to lock while checking
+	results := slo.NewPingTracker()
+	ctx, cancel := context.WithTimeout(c.ctx, mconfig.TimeoutDuration)
+	err := lib.CheckTCP(ctx, results, mconfig)
+	cancel()
+	if err != nil {
+		fmt.Println("TCP check failed", err.Error())
+	}
+
+	c.recordPingSLO("tcp", name, fmt.Sprintf("Host: %s:%d", mconfig.Host, mconfig.Port), nil, results, pingSLO{
+		HistoryRetained:   mconfig.SLO.HistoryRetained,
+		MaxFailuresInARow: mconfig.SLO.MaxFailuresInARow,
+		UptimeTarget:      mconfig.SLO.UptimeTarget,
+		ErrorBudget:       mconfig.SLO.ErrorBudget,
+		SampleGuardConfig: mconfig.SLO.SampleGuardConfig,
+		MaxRTT:            mconfig.SLO.MaxConnectTime,
+		RTTTarget:         mconfig.SLO.ConnectTimeTarget,
+	}, pingNouns{
+		Slow:  "Port is very slow to connect",
+		Tests: "connections",
+	}, mconfig.Tags, mconfig.Notify, err)
+}
+
+// CheckOpenVPN performs a handshake with the given OpenVPN gateway and alerts if its SLOs aren't being met.
+func (c *Checker) CheckOpenVPN(name string, mconfig lib.OpenVPNConfig) {
+	// get which set of creds to use
+	credsToUse := lib.GetCounter(c.db, fmt.Sprintf("openvpn-%s-%d-credentials", mconfig.Host, mconfig.Port), len(mconfig.Credentials)-1)
+
+	// check! results go into their own tracker so we don't need to lock while checking
+	results := slo.NewPingTracker()
+	ctx, cancel := context.WithTimeout(c.ctx, mconfig.TimeoutDuration)
+	err := lib.CheckOpenVPN(ctx, results, mconfig, credsToUse)
+	cancel()
+	if err != nil {
+		fmt.Println("OpenVPN check failed", err.Error())
+	}
+	if len(mconfig.Credentials) > 0 {
+		results.AttributeTo(mconfig.Credentials[credsToUse].Username)
+	}
+
+	c.recordPingSLO("openvpn", name, fmt.Sprintf("Host: %s:%d (%s)", mconfig.Host, mconfig.Port, strings.ToUpper(mconfig.Protocol)), mconfig.Credentials, results, pingSLO{
+		HistoryRetained:       mconfig.SLO.HistoryRetained,
+		MaxFailuresInARow:     mconfig.SLO.MaxFailuresInARow,
+		UptimeTarget:          mconfig.SLO.UptimeTarget,
+		ErrorBudget:           mconfig.SLO.ErrorBudget,
+		SampleGuardConfig:     mconfig.SLO.SampleGuardConfig,
+		MaxRTT:                mconfig.SLO.MaxHandshakeTime,
+		RTTTarget:             mconfig.SLO.HandshakeTimeTarget,
+		MaxAuthFailuresInARow: mconfig.SLO.MaxAuthFailuresInARow,
+	}, pingNouns{
+		Slow:  "Gateway is very slow",
+		Tests: "handshakes",
+	}, mconfig.Tags, mconfig.Notify, err)
+}
+
+// CheckWireGuard performs a handshake with the given WireGuard endpoint and alerts if its SLOs aren't being met.
+func (c *Checker) CheckWireGuard(name string, mconfig lib.WireGuardConfig) {
+	// check! results go into their own tracker so we don't need to lock while checking
+	results := slo.NewPingTracker()
+	ctx, cancel := context.WithTimeout(c.ctx, mconfig.TimeoutDuration)
+	err := lib.CheckWireGuard(ctx, results, mconfig)
+	cancel()
+	if err != nil {
+		fmt.Println("WireGuard check failed", err.Error())
+	}
+
+	c.recordPingSLO("wireguard", name, fmt.Sprintf("Endpoint: %s", mconfig.Endpoint), nil, results, pingSLO{
+		HistoryRetained:   mconfig.SLO.HistoryRetained,
+		MaxFailuresInARow: mconfig.SLO.MaxFailuresInARow,
+		UptimeTarget:      mconfig.SLO.UptimeTarget,
+		ErrorBudget:       mconfig.SLO.ErrorBudget,
+		SampleGuardConfig: mconfig.SLO.SampleGuardConfig,
+		MaxRTT:            mconfig.SLO.MaxRTT,
+		RTTTarget:         mconfig.SLO.RTTTarget,
+	}, pingNouns{
+		Slow:  "Endpoint is very slow",
+		Tests: "handshakes",
+	}, mconfig.Tags, mconfig.Notify, err)
+}
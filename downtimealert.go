@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"math/rand"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"time"
 
@@ -13,7 +17,6 @@ import (
 
 	"net"
 
-	"code.cloudfoundry.org/bytefmt"
 	"github.com/tidwall/buntdb"
 )
 
@@ -21,21 +24,69 @@ const (
 	keySloTracker = "slo-tracker %s %s"
 )
 
-// FailAndNotify notifies about the failure using whatever methods have been selected and errors out.
-func FailAndNotify(nconfig lib.NotifyConfig, serviceName string, errorMessage string) {
-	message := fmt.Sprintf("== %s is down ==\n%s", serviceName, errorMessage)
+// FailAndNotify notifies the given targets about the failure using whatever methods have been selected.
+func FailAndNotify(nconfig lib.NotifyConfig, targets lib.NotifyTargetsConfig, serviceName string, errorMessage string) {
+	notify(nconfig, targets, serviceName, fmt.Sprintf("== %s is down ==\n%s", serviceName, errorMessage))
+}
+
+// EgressFailAndNotify notifies the given targets that traffic through a proxy isn't exiting where it should.
+func EgressFailAndNotify(nconfig lib.NotifyConfig, targets lib.NotifyTargetsConfig, serviceName string, errorMessage string) {
+	notify(nconfig, targets, serviceName, fmt.Sprintf("== %s egress mismatch ==\n%s", serviceName, errorMessage))
+}
+
+// WarnAndNotify notifies the given targets about a problem that hasn't caused a failure yet.
+func WarnAndNotify(nconfig lib.NotifyConfig, targets lib.NotifyTargetsConfig, serviceName string, warningMessage string) {
+	notify(nconfig, targets, serviceName, fmt.Sprintf("== %s warning ==\n%s", serviceName, warningMessage))
+}
+
+// FlapAndNotify notifies the given targets that a service has started or stopped flapping.
+// errorMessage is empty if the service is currently up.
+func FlapAndNotify(nconfig lib.NotifyConfig, targets lib.NotifyTargetsConfig, serviceName string, status lib.FlapStatus, errorMessage string) {
+	current := "It's currently up."
+	if errorMessage != "" {
+		current = fmt.Sprintf("It's currently down:\n%s", errorMessage)
+	}
+
+	if status.State == lib.FlapStarted {
+		notify(nconfig, targets, serviceName, fmt.Sprintf("== %s is flapping ==\nState changed in %.0f%% of the last %d checks, up and down alerts are paused until it stabilises.\n%s", serviceName, status.StateChange*100, status.Checks, current))
+	} else {
+		notify(nconfig, targets, serviceName, fmt.Sprintf("== %s has stopped flapping ==\nState changed in %.0f%% of the last %d checks.\n%s", serviceName, status.StateChange*100, status.Checks, current))
+	}
+}
+
+// RecoverAndNotify notifies the given targets that the service is back up, if they were alerted about it.
+func RecoverAndNotify(nconfig lib.NotifyConfig, targets lib.NotifyTargetsConfig, serviceName string, downtime *lib.Downtime) {
+	if downtime == nil {
+		return
+	}
+	if downtime.Alerts < 1 {
+		log.Println(serviceName, "is back up, no alerts were sent so not notifying")
+		return
+	}
+
+	notify(nconfig, targets, serviceName, fmt.Sprintf("== %s is back up ==\nDown since: %s\nDowntime: %s\nAlerts sent: %d", serviceName, downtime.Started.Format(time.RFC1123), downtime.Duration(), downtime.Alerts))
+}
+
+// notify sends the given message to the given targets and logs the results.
+func notify(nconfig lib.NotifyConfig, targets lib.NotifyTargetsConfig, serviceName string, message string) {
 	log.Println(message)
 
-	// send Telstra SMS to the given phone numbers.
-	for _, phoneNumber := range nconfig.DefaultTargets.SmsTelstra {
-		log.Println("Sending SMS notification of failure to", phoneNumber)
-		lib.SendSMSTelstra(nconfig.SmsTelstra.Key, nconfig.SmsTelstra.Secret, phoneNumber, message)
+	results := lib.SendNotification(nconfig, targets, message)
+
+	var failures int
+	for _, result := range results {
+		if result.Err != nil {
+			failures++
+			log.Printf("Failed to send %s notification to %s: %s", result.Notifier, result.Target, result.Err.Error())
+		} else {
+			log.Printf("Sent %s notification to %s", result.Notifier, result.Target)
+		}
 	}
 
-	// send Sendgrid emails to the given targets.
-	if len(nconfig.DefaultTargets.EmailSendgrid) > 0 {
-		log.Println("Sending email notification of failure to", nconfig.DefaultTargets.EmailSendgrid)
-		lib.SendEmailSendgrid(nconfig.EmailSendgrid.APIKey, nconfig.EmailSendgrid.FromName, nconfig.EmailSendgrid.FromAddress, nconfig.DefaultTargets.EmailSendgrid, message)
+	if len(results) < 1 {
+		log.Println("No notification targets are configured, nobody was notified about", serviceName)
+	} else if failures == len(results) {
+		log.Println("All", failures, "notifications failed, nobody was notified about", serviceName)
 	}
 }
 
@@ -69,12 +120,57 @@ func LoadPingTrackerFromDatastore(db *buntdb.DB, section, name string) (*slo.Pin
 	return tracker, err
 }
 
+// setup loads the config and datastore, notifying about (and exiting on) any errors.
+// The returned function cleans up the onecopy listener and datastore.
+func setup(arguments map[string]interface{}) (*lib.Config, *buntdb.DB, func()) {
+	// load config
+	config, err := lib.LoadConfig(arguments["--config"].(string))
+	if err != nil {
+		// try notifying if we can
+		if config != nil {
+			FailAndNotify(config.Notify, config.Notify.DefaultTargets, "Config", fmt.Sprintf("Failed to load config: %s", err.Error()))
+		}
+
+		log.Fatal("Could not load config file: ", err.Error())
+	}
+
+	// ensure only one copy of this alerter exists
+	var onecopy net.Listener
+	if arguments["--onecopy"].(bool) {
+		onecopy, err = net.Listen("tcp", config.Onecopy)
+		if err != nil {
+			// a downtimealert is already running, so exit
+			log.Println("Downtime alerter already running, exiting")
+			os.Exit(0)
+		}
+		log.Println("Opened onecopy listener at", config.Onecopy)
+	}
+
+	// load datastore
+	db, err := buntdb.Open(config.Datastore)
+	if err != nil {
+		FailAndNotify(config.Notify, config.Notify.DefaultTargets, "Datastore", fmt.Sprintf("Couldn't open bunt datastore: %s", err.Error()))
+		os.Exit(1)
+	}
+
+	// seed random numbers (used to uniquify URLs to bypass caches)
+	rand.Seed(time.Now().UnixNano())
+
+	return config, db, func() {
+		db.Close()
+		if onecopy != nil {
+			onecopy.Close()
+		}
+	}
+}
+
 func main() {
 	usage := `downtimealert.
 downtimealert connects to and monitors services, and reports outages.
 
 Usage:
 	downtimealert try [--config=<filename>] [--onecopy]
+	downtimealert run [--config=<filename>] [--onecopy]
 	downtimealert -h | --help
 	downtimealert --version
 
@@ -90,39 +186,14 @@ Options:
 	if arguments["try"].(bool) {
 		log.Println("Trying services")
 
-		// load config
-		config, err := lib.LoadConfig(arguments["--config"].(string))
-		if err != nil {
-			// try notifying if we can
-			if config != nil {
-				FailAndNotify(config.Notify, "Config", fmt.Sprintf("Failed to load config: %s", err.Error()))
-			}
+		config, db, cleanup := setup(arguments)
+		defer cleanup()
 
-			log.Fatal("Could not load config file: ", err.Error())
-		}
+		checker := NewChecker(context.Background(), config, db)
+		defer checker.Flush()
 
-		// ensure only one copy of this alerter exists
-		if arguments["--onecopy"].(bool) {
-			onecopy, err := net.Listen("tcp", config.Onecopy)
-			if err != nil {
-				// a downtimealert is already running, so exit
-				log.Println("Downtime alerter already running, exiting")
-				return
-			}
-			log.Println("Opened onecopy listener at", config.Onecopy)
-			defer onecopy.Close()
-		}
-
-		// load datastore
-		db, err := buntdb.Open(config.Datastore)
-		if err != nil {
-			FailAndNotify(config.Notify, "Datastore", fmt.Sprintf("Couldn't open bunt datastore: %s", err.Error()))
-			return
-		}
-		defer db.Close()
-
-		// seed random numbers (used to uniquify URLs to bypass caches)
-		rand.Seed(time.Now().UnixNano())
+		// collect our checks, and then run them concurrently
+		var checks []func()
 
 		// check SOCKS5 proxies
 		for name, mconfig := range config.Services.Socks5 {
@@ -134,80 +205,122 @@ Options:
 				continue
 			}
 
-			// get which set of creds to use
-			credsToUse := lib.GetCounter(db, fmt.Sprintf("socks5-%s-%d-credentials", mconfig.Host, mconfig.Port), len(mconfig.Credentials)-1)
+			name, mconfig := name, mconfig
+			checks = append(checks, func() {
+				checker.CheckSocks5(name, mconfig)
+			})
+		}
 
-			// confirm that we have our SLO tracker
-			tracker, err := LoadDownloadTrackerFromDatastore(db, "socks5", name)
-			if err != nil {
-				tracker = slo.NewDownloadTracker()
-			}
+		// check HTTP proxies
+		for name, mconfig := range config.Services.HTTPProxy {
+			// see whether to skip check on this launch
+			countWait := lib.GetCounter(db, fmt.Sprintf("http-proxy-%s-%d-countwait", mconfig.Host, mconfig.Port), mconfig.WaitBetweenAttempts)
 
-			// check!
-			err = lib.CheckSocks5(tracker, mconfig, credsToUse)
-			if err != nil {
-				tracker.AddFailure(time.Now(), err.Error())
-				fmt.Println("SOCKS5 check failed:", err.Error())
+			if countWait != 0 {
+				log.Println("Skipping HTTP proxy check for", mconfig.Host, "this launch")
+				continue
 			}
 
-			// remove old history
-			tracker.CullHistory(time.Now().Add(mconfig.TestDownload.SLO.HistoryRetained * -1))
-
-			// check specific failures
-			//TODO(dan): Don't alert 3000 times for the same issue, implement failure pattern detection and hiding and all.
-			// We'll likely integrate this in as a "ShouldAlert" function into the tracker itself.
-			failCount, failMessages := tracker.ConsecutiveFailures()
-			var alerted bool
-			if !alerted && failCount >= mconfig.TestDownload.SLO.MaxFailuresInARow {
-				FailAndNotify(config.Notify, name, fmt.Sprintf("Failed %d times in a row:\n%s", failCount, failMessages))
-				alerted = true
-			}
+			name, mconfig := name, mconfig
+			checks = append(checks, func() {
+				checker.CheckHTTPProxy(name, mconfig)
+			})
+		}
+
+		// check OpenVPN gateways
+		for name, mconfig := range config.Services.OpenVPN {
+			// see whether to skip check on this launch
+			countWait := lib.GetCounter(db, fmt.Sprintf("openvpn-%s-%d-countwait", mconfig.Host, mconfig.Port), mconfig.WaitBetweenAttempts)
 
-			if !alerted && tracker.TotalTestsPerformed() >= 3 && !tracker.UptimeIsAbove(mconfig.TestDownload.SLO.UptimeTarget) {
-				FailAndNotify(config.Notify, name, fmt.Sprintf("Uptime is lower than %f", mconfig.TestDownload.SLO.UptimeTarget))
-				alerted = true
+			if countWait != 0 {
+				log.Println("Skipping OpenVPN check for", mconfig.Host, "this launch")
+				continue
 			}
 
-			if !alerted && tracker.SuccessfulTestsPerformed() >= 3 && !tracker.SpeedIsAbove(mconfig.TestDownload.SLO.MinBytesPerSecond, mconfig.TestDownload.SLO.SpeedTarget) {
-				FailAndNotify(config.Notify, name, fmt.Sprintf("Proxy is very slow. Target of %s/s for %d%% of connections not met -- average is %s from %d tests", bytefmt.ByteSize(mconfig.TestDownload.SLO.MinBytesPerSecond), int(mconfig.TestDownload.SLO.SpeedTarget*100), tracker.AverageSpeed(), len(tracker.History)))
-				alerted = true
+			name, mconfig := name, mconfig
+			checks = append(checks, func() {
+				checker.CheckOpenVPN(name, mconfig)
+			})
+		}
+
+		// check WireGuard endpoints
+		for name, mconfig := range config.Services.WireGuard {
+			// see whether to skip check on this launch
+			countWait := lib.GetCounter(db, fmt.Sprintf("wireguard-%s-countwait", mconfig.Endpoint), mconfig.WaitBetweenAttempts)
+
+			if countWait != 0 {
+				log.Println("Skipping WireGuard check for", mconfig.Endpoint, "this launch")
+				continue
 			}
 
-			// save tracker
-			sloTrackerKey := fmt.Sprintf(keySloTracker, "socks5", name)
-			db.Update(func(tx *buntdb.Tx) error {
-				tx.Set(sloTrackerKey, tracker.String(), nil)
-				return nil
+			name, mconfig := name, mconfig
+			checks = append(checks, func() {
+				checker.CheckWireGuard(name, mconfig)
 			})
 		}
 
 		// check web pages
 		for name, mconfig := range config.Services.Webpage {
-			// require two failures in a row to report it, to prevent notification on momentary net glitches
-			var failure bool
-
-			err = lib.CheckWebpage(name, mconfig)
-			if err != nil {
-				// wait for momentary net glitches to pass
-				time.Sleep(config.RecheckDelayDuration)
-				log.Printf("Page failed [%s], retrying", err.Error())
-				err = lib.CheckWebpage(name, mconfig)
-				if err != nil {
-					failure = true
-					log.Printf("Page failed again [%s]", err.Error())
-				}
+			name, mconfig := name, mconfig
+			checks = append(checks, func() {
+				checker.CheckWebpage(name, mconfig)
+			})
+		}
+
+		// check JSON APIs
+		for name, mconfig := range config.Services.JSONAPI {
+			name, mconfig := name, mconfig
+			checks = append(checks, func() {
+				checker.CheckJSONAPI(name, mconfig)
+			})
+		}
+
+		// check transactions
+		for name, mconfig := range config.Services.Transaction {
+			name, mconfig := name, mconfig
+			checks = append(checks, func() {
+				checker.CheckTransaction(name, mconfig)
+			})
+		}
+
+		// check TLS certificates
+		for name, mconfig := range config.Services.TLS {
+			name, mconfig := name, mconfig
+			checks = append(checks, func() {
+				checker.CheckTLS(name, mconfig)
+			})
+		}
+
+		// check DNS servers
+		for name, mconfig := range config.Services.DNS {
+			// see whether to skip check on this launch
+			countWait := lib.GetCounter(db, fmt.Sprintf("dns-%s-%d-countwait", mconfig.Nameserver, mconfig.Port), mconfig.WaitBetweenAttempts)
+
+			if countWait != 0 {
+				log.Println("Skipping DNS check for", mconfig.Nameserver, "this launch")
+				continue
 			}
 
-			if failure {
-				lib.MarkDown(db, "webpage", name)
+			name, mconfig := name, mconfig
+			checks = append(checks, func() {
+				checker.CheckDNS(name, mconfig)
+			})
+		}
+
+		// check TCP ports
+		for name, mconfig := range config.Services.TCP {
+			// see whether to skip check on this launch
+			countWait := lib.GetCounter(db, fmt.Sprintf("tcp-%s-%d-countwait", mconfig.Host, mconfig.Port), mconfig.WaitBetweenAttempts)
 
-				// if we should alert the customer, go yell at them
-				if lib.ShouldAlertDowntime(db, config.Ongoing, "webpage", name, 2) {
-					FailAndNotify(config.Notify, name, fmt.Sprintf("URL: %s\nStatus: %s", mconfig.URL, err.Error()))
-				}
-			} else {
-				lib.MarkUp(db, "webpage", name)
+			if countWait != 0 {
+				log.Println("Skipping TCP check for", mconfig.Host, mconfig.Port, "this launch")
+				continue
 			}
+
+			name, mconfig := name, mconfig
+			checks = append(checks, func() {
+				checker.CheckTCP(name, mconfig)
+			})
 		}
 
 		// check Ping proxies
@@ -220,48 +333,108 @@ Options:
 				continue
 			}
 
-			// confirm that we have our SLO tracker
-			tracker, err := LoadPingTrackerFromDatastore(db, "ping", name)
-			if err != nil {
-				tracker = slo.NewPingTracker()
-			}
+			name, mconfig := name, mconfig
+			checks = append(checks, func() {
+				checker.CheckPing(name, mconfig)
+			})
+		}
 
-			// check!
-			err = lib.CheckPing(tracker, mconfig)
-			if err != nil {
-				tracker.AddFailure(time.Now())
-				fmt.Println("PING check failed", err.Error())
-			}
+		lib.RunAll(config.MaxConcurrency, checks)
+	} else if arguments["run"].(bool) {
+		log.Println("Running as a daemon")
 
-			// remove old history
-			tracker.CullHistory(time.Now().Add(mconfig.SLO.HistoryRetained * -1))
-
-			// check specific failures
-			//TODO(dan): Don't alert 3000 times for the same issue, implement failure pattern detection and hiding and all.
-			// We'll likely integrate this in as a "ShouldAlert" function into the tracker itself.
-			failCount := tracker.ConsecutiveFailures()
-			var alerted bool
-			if !alerted && failCount >= mconfig.SLO.MaxFailuresInARow {
-				FailAndNotify(config.Notify, name, fmt.Sprintf("Failed %d times in a row", failCount))
-				alerted = true
-			}
+		config, db, cleanup := setup(arguments)
+		defer cleanup()
 
-			if !alerted && tracker.TotalTestsPerformed() >= 3 && !tracker.UptimeIsAbove(mconfig.SLO.UptimeTarget) {
-				FailAndNotify(config.Notify, name, fmt.Sprintf("Uptime is lower than %f", 100.0*mconfig.SLO.UptimeTarget))
-				alerted = true
-			}
+		// cancelled when we're told to stop, so in-progress checks finish quickly
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
 
-			if !alerted && tracker.SuccessfulTestsPerformed() >= 16 && !tracker.AvgRTTIsBelow(mconfig.SLO.MaxRTT, mconfig.SLO.SpeedTarget) {
-				FailAndNotify(config.Notify, name, fmt.Sprintf("Host is very slow. Target of %v for %d%% of connections not met -- average is %v from %d tests", mconfig.SLO.MaxRTT, int(mconfig.SLO.SpeedTarget*100), tracker.AverageRTT(), len(tracker.History)))
-				alerted = true
-			}
+		checker := NewChecker(ctx, config, db)
+		defer checker.Flush()
+
+		// schedule everything. wait-between-attempts is replaced by each service's interval here
+		scheduler := lib.NewScheduler(config.Daemon.MaxJitter, config.MaxConcurrency)
 
-			// save tracker
-			sloTrackerKey := fmt.Sprintf(keySloTracker, "ping", name)
-			db.Update(func(tx *buntdb.Tx) error {
-				tx.Set(sloTrackerKey, tracker.String(), nil)
-				return nil
+		for name, mconfig := range config.Services.Socks5 {
+			name, mconfig := name, mconfig
+			scheduler.Add("SOCKS5 "+name, mconfig.IntervalDuration, func() {
+				checker.CheckSocks5(name, mconfig)
+			})
+		}
+		for name, mconfig := range config.Services.HTTPProxy {
+			name, mconfig := name, mconfig
+			scheduler.Add("HTTP proxy "+name, mconfig.IntervalDuration, func() {
+				checker.CheckHTTPProxy(name, mconfig)
+			})
+		}
+		for name, mconfig := range config.Services.OpenVPN {
+			name, mconfig := name, mconfig
+			scheduler.Add("OpenVPN "+name, mconfig.IntervalDuration, func() {
+				checker.CheckOpenVPN(name, mconfig)
+			})
+		}
+		for name, mconfig := range config.Services.WireGuard {
+			name, mconfig := name, mconfig
+			scheduler.Add("WireGuard "+name, mconfig.IntervalDuration, func() {
+				checker.CheckWireGuard(name, mconfig)
+			})
+		}
+		for name, mconfig := range config.Services.Webpage {
+			name, mconfig := name, mconfig
+			scheduler.Add("webpage "+name, mconfig.IntervalDuration, func() {
+				checker.CheckWebpage(name, mconfig)
+			})
+		}
+		for name, mconfig := range config.Services.JSONAPI {
+			name, mconfig := name, mconfig
+			scheduler.Add("JSON API "+name, mconfig.IntervalDuration, func() {
+				checker.CheckJSONAPI(name, mconfig)
+			})
+		}
+		for name, mconfig := range config.Services.Transaction {
+			name, mconfig := name, mconfig
+			scheduler.Add("transaction "+name, mconfig.IntervalDuration, func() {
+				checker.CheckTransaction(name, mconfig)
+			})
+		}
+		for name, mconfig := range config.Services.TLS {
+			name, mconfig := name, mconfig
+			scheduler.Add("TLS "+name, mconfig.IntervalDuration, func() {
+				checker.CheckTLS(name, mconfig)
+			})
+		}
+		for name, mconfig := range config.Services.DNS {
+			name, mconfig := name, mconfig
+			scheduler.Add("DNS "+name, mconfig.IntervalDuration, func() {
+				checker.CheckDNS(name, mconfig)
+			})
+		}
+		for name, mconfig := range config.Services.TCP {
+			name, mconfig := name, mconfig
+			scheduler.Add("TCP "+name, mconfig.IntervalDuration, func() {
+				checker.CheckTCP(name, mconfig)
+			})
+		}
+		for name, mconfig := range config.Services.Ping {
+			name, mconfig := name, mconfig
+			scheduler.Add("PING "+name, mconfig.IntervalDuration, func() {
+				checker.CheckPing(name, mconfig)
 			})
 		}
+		scheduler.Add("SLO tracker flush", config.Daemon.FlushInterval, checker.Flush)
+
+		// stop cleanly so trackers get flushed
+		stop := make(chan struct{})
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			sig := <-signals
+			log.Println("Received", sig, "- stopping")
+			close(stop)
+			cancel()
+		}()
+
+		scheduler.Run(stop)
 	}
 }
@@ -1,59 +1,173 @@
 package lib
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 
 	"time"
 
 	"code.cloudfoundry.org/bytefmt"
+	"github.com/LondonTrustMedia/downtime_alert/lib/slo"
 	"gopkg.in/yaml.v2"
 )
 
 // OngoingConfig holds the configuration used for ongoing issues.
 type OngoingConfig struct {
-	InitialMaxAlerts int    `yaml:"initial-max-alerts"`
-	OngoingDelay     string `yaml:"ongoing-delay"`
+	InitialMaxAlerts int        `yaml:"initial-max-alerts"`
+	OngoingDelay     string     `yaml:"ongoing-delay"`
+	Flapping         FlapConfig `yaml:"flapping"`
 }
 
-// SendgridAddressConfig holds the config for a Sendgrid email address
-type SendgridAddressConfig struct {
-	Name    string
-	Address string
+// FlapConfig holds the configuration used to detect services that keep going up and down.
+type FlapConfig struct {
+	Disable bool
+	// Window is how many of the latest checks to look for state changes in.
+	Window int
+	// A service starts flapping when its state changes in more than HighThreshold of the checks in the
+	// window, and stops once that's below LowThreshold.
+	HighThreshold float64 `yaml:"high-threshold"`
+	LowThreshold  float64 `yaml:"low-threshold"`
+}
+
+// parse sets our defaults and confirms our thresholds are valid.
+func (fc *FlapConfig) parse() error {
+	if fc.Window < 1 {
+		fc.Window = 21
+	}
+	if fc.HighThreshold == 0 {
+		fc.HighThreshold = 0.3
+	}
+	if fc.LowThreshold == 0 {
+		fc.LowThreshold = 0.1
+	}
+
+	if fc.Window < 3 {
+		return errors.New("window must be at least 3 checks")
+	}
+	if fc.HighThreshold < 0 || 1 < fc.HighThreshold || fc.LowThreshold < 0 || 1 < fc.LowThreshold {
+		return errors.New("high-threshold and low-threshold must be between 0 and 1")
+	}
+	if fc.HighThreshold < fc.LowThreshold {
+		return errors.New("high-threshold must be above low-threshold")
+	}
+	return nil
 }
 
-// NotifyTargetsConfig holds notification targets.
-type NotifyTargetsConfig struct {
-	SmsTelstra    []string                `yaml:"sms-telstra"`
-	EmailSendgrid []SendgridAddressConfig `yaml:"email-sendgrid"`
+// DaemonConfig holds the configuration used when running as a long-running daemon.
+type DaemonConfig struct {
+	DefaultIntervalString string `yaml:"default-interval"`
+	DefaultInterval       time.Duration
+	MaxJitterString       string `yaml:"max-jitter"`
+	MaxJitter             time.Duration
+	FlushIntervalString   string `yaml:"flush-interval"`
+	FlushInterval         time.Duration
 }
 
-// SmsTelstraConfig holds the configuration for Telsta SMS notifications.
-type SmsTelstraConfig struct {
-	Key    string
-	Secret string
+// NotifyTargetsConfig holds notification targets, keyed by the notifier's name. Each notifier parses
+// its own targets.
+type NotifyTargetsConfig map[string]interface{}
+
+// ServiceNotifyConfig changes which targets are notified about a specific service.
+type ServiceNotifyConfig struct {
+	// Mode is one of "add" (the default), "replace" or "none".
+	Mode    string
+	Targets NotifyTargetsConfig `yaml:",inline"`
 }
 
-// EmailSendgridConfig holds the configuration for Sendgrid email notifications.
-type EmailSendgridConfig struct {
-	FromName    string `yaml:"from-name"`
-	FromAddress string `yaml:"from-address"`
-	APIKey      string `yaml:"api-key"`
+// NotifyRouteConfig is a routing rule that changes the notify targets of matching services.
+type NotifyRouteConfig struct {
+	// Section is the services section to match, e.g. "webpage" or "socks5". Empty matches all sections.
+	Section string
+	// Name is a glob matched against the service name. Empty matches all names.
+	Name string
+	// Tags matches services that have at least one of these tags. Empty matches all services.
+	Tags []string
+	// Mode and Targets are applied to matching services, in the same way as ServiceNotifyConfig.
+	Mode    string
+	Targets NotifyTargetsConfig `yaml:",inline"`
 }
 
 // NotifyConfig holds the configuration for the notifiers.
 type NotifyConfig struct {
 	DefaultTargets NotifyTargetsConfig `yaml:"default-targets"`
-	SmsTelstra     SmsTelstraConfig    `yaml:"sms-telstra"`
-	EmailSendgrid  EmailSendgridConfig `yaml:"email-sendgrid"`
+	Routes         []NotifyRouteConfig
+	// Notifiers holds each notifier's own settings, keyed by its name.
+	Notifiers map[string]interface{} `yaml:",inline"`
 }
 
 // WebpageConfig holds the monitor configuration for a web page.
 type WebpageConfig struct {
-	URL        string
-	UserAgent  string   `yaml:"user-agent"`
-	UserAgents []string `yaml:"user-agents"`
-	Matches    []string
+	URL              string
+	Interval         string `yaml:"interval"`
+	IntervalDuration time.Duration
+	Timeout          string `yaml:"timeout"`
+	TimeoutDuration  time.Duration
+	UserAgent        string   `yaml:"user-agent"`
+	UserAgents       []string `yaml:"user-agents"`
+	Tags             []string
+	Notify           ServiceNotifyConfig
+
+	// CheckTLS also monitors the URL's TLS certificate, as if it were in the tls section.
+	CheckTLS             bool     `yaml:"check-tls"`
+	TLSWarningThresholds []string `yaml:"tls-warning-thresholds"`
+
+	HTTPRequestConfig    `yaml:",inline"`
+	HTTPAssertionsConfig `yaml:",inline"`
+}
+
+// JSONAPIConfig holds the monitor configuration for a JSON API endpoint.
+type JSONAPIConfig struct {
+	WebpageConfig `yaml:",inline"`
+	JSON          []JSONAssertionConfig
+}
+
+// TransactionStepConfig is a single HTTP request in a transaction.
+type TransactionStepConfig struct {
+	Name    string
+	URL     string
+	JSON    []JSONAssertionConfig
+	Extract []ExtractConfig
+
+	HTTPRequestConfig    `yaml:",inline"`
+	HTTPAssertionsConfig `yaml:",inline"`
+}
+
+// TransactionConfig holds the monitor configuration for a transaction, an ordered list of HTTP
+// requests that share cookies and can pass variables to each other.
+type TransactionConfig struct {
+	Interval         string `yaml:"interval"`
+	IntervalDuration time.Duration
+	Timeout          string `yaml:"timeout"`
+	TimeoutDuration  time.Duration
+	UserAgent        string `yaml:"user-agent"`
+	Steps            []TransactionStepConfig
+	Tags             []string
+	Notify           ServiceNotifyConfig
+}
+
+// TLSConfig holds the monitor configuration for a TLS certificate.
+type TLSConfig struct {
+	Host             string
+	Port             int
+	ServerName       string `yaml:"server-name"`
+	Interval         string `yaml:"interval"`
+	IntervalDuration time.Duration
+	Timeout          string `yaml:"timeout"`
+	TimeoutDuration  time.Duration
+	// WarningThresholds are how long before expiry to alert, e.g. 21d, 7d, 1d.
+	WarningThresholds          []string `yaml:"warning-thresholds"`
+	WarningThresholdsDurations []time.Duration
+	Tags                       []string
+	Notify                     ServiceNotifyConfig
 }
 
 // UserPassCredentialConfig holds credentials for typical username+password services.
@@ -62,45 +176,550 @@ type UserPassCredentialConfig struct {
 	Password string
 }
 
+// SampleGuardConfig sets how many samples an SLO needs before it's evaluated, and optionally how
+// confident we need to be that it's been missed before alerting.
+type SampleGuardConfig struct {
+	MinSamples int     `yaml:"min-samples"`
+	Confidence float64 `yaml:"confidence"`
+}
+
+// parse confirms our min samples and confidence are valid.
+func (sg SampleGuardConfig) parse() error {
+	if sg.MinSamples < 0 {
+		return errors.New("min-samples can't be negative")
+	}
+	if sg.Confidence < 0 || 1 <= sg.Confidence {
+		return errors.New("confidence must be between 0 and 1")
+	}
+	return nil
+}
+
+// Guard returns the slo.Guard to evaluate SLOs with, using the given number of samples if min-samples
+// isn't set.
+func (sg SampleGuardConfig) Guard(defaultMinSamples int) slo.Guard {
+	guard := slo.Guard{
+		MinSamples: sg.MinSamples,
+	}
+	if guard.MinSamples < 1 {
+		guard.MinSamples = defaultMinSamples
+	}
+	if 0 < sg.Confidence {
+		// one-sided, as we only care whether the SLO is being missed
+		guard.Z = math.Sqrt2 * math.Erfinv(2*sg.Confidence-1)
+	}
+	return guard
+}
+
+// ErrorBudgetConfig sets an uptime target over a long compliance period, e.g. 99.5% over 30 days, and
+// alerts when the error budget is being used up too quickly.
+type ErrorBudgetConfig struct {
+	Target         float64
+	PeriodString   string `yaml:"period"`
+	PeriodDuration time.Duration
+	BurnRates      []BurnRateRuleConfig `yaml:"burn-rates"`
+	Rules          []slo.BurnRateRule
+}
+
+// BurnRateRuleConfig is a single burn rate alerting rule, see slo.BurnRateRule.
+type BurnRateRuleConfig struct {
+	LongWindow  string  `yaml:"long-window"`
+	ShortWindow string  `yaml:"short-window"`
+	BurnRate    float64 `yaml:"burn-rate"`
+}
+
+// defaultBurnRates are used for error budgets that don't have their own burn rates set. Over a 30 day
+// period, these fire when 2% of the budget is used in an hour, or 5% in six hours.
+var defaultBurnRates = []slo.BurnRateRule{
+	{LongWindow: time.Hour, ShortWindow: 5 * time.Minute, BurnRate: 14.4},
+	{LongWindow: 6 * time.Hour, ShortWindow: 30 * time.Minute, BurnRate: 6},
+}
+
+// Enabled returns true if an error budget has been set.
+func (eb ErrorBudgetConfig) Enabled() bool {
+	return eb.Target > 0
+}
+
+// Retention returns how long results need to be kept for this error budget.
+func (eb ErrorBudgetConfig) Retention(historyRetained time.Duration) time.Duration {
+	if !eb.Enabled() {
+		return historyRetained
+	}
+	retention := eb.PeriodDuration
+	for _, rule := range eb.Rules {
+		if retention < rule.LongWindow {
+			retention = rule.LongWindow
+		}
+	}
+	return retention
+}
+
+// parse parses our period and burn rate rules.
+func (eb *ErrorBudgetConfig) parse() error {
+	if !eb.Enabled() {
+		return nil
+	}
+	if 1 <= eb.Target {
+		return errors.New("target must be between 0 and 1")
+	}
+
+	var err error
+	eb.PeriodDuration = 30 * 24 * time.Hour
+	if eb.PeriodString != "" {
+		eb.PeriodDuration, err = parseLongDuration(eb.PeriodString)
+		if err != nil {
+			return fmt.Errorf("Could not parse period: %s", err.Error())
+		}
+	}
+
+	eb.Rules = nil
+	for i, rule := range eb.BurnRates {
+		longWindow, err := parseLongDuration(rule.LongWindow)
+		if err != nil {
+			return fmt.Errorf("Could not parse long-window in burn rate %d: %s", i+1, err.Error())
+		}
+		shortWindow, err := parseLongDuration(rule.ShortWindow)
+		if err != nil {
+			return fmt.Errorf("Could not parse short-window in burn rate %d: %s", i+1, err.Error())
+		}
+		if longWindow <= shortWindow {
+			return fmt.Errorf("long-window must be longer than short-window in burn rate %d", i+1)
+		}
+		if rule.BurnRate <= 0 {
+			return fmt.Errorf("burn-rate must be set in burn rate %d", i+1)
+		}
+		eb.Rules = append(eb.Rules, slo.BurnRateRule{
+			LongWindow:  longWindow,
+			ShortWindow: shortWindow,
+			BurnRate:    rule.BurnRate,
+		})
+	}
+	if len(eb.Rules) < 1 {
+		eb.Rules = defaultBurnRates
+	}
+
+	return nil
+}
+
 // TestDownloadConfig is the info for a test download.
 type TestDownloadConfig struct {
 	URL               string
 	MaxSizeToDLString string `yaml:"max-size-to-dl"`
 	MaxBytesToDL      uint64
-	SLO               struct {
+
+	// status codes default to any 2xx response here, as range requests return 206
+	HTTPAssertionsConfig `yaml:",inline"`
+
+	SLO struct {
 		HistoryRetainedString   string `yaml:"history-retained"`
 		HistoryRetained         time.Duration
-		MaxFailuresInARow       int     `yaml:"max-failures-in-a-row"`
-		UptimeTarget            float64 `yaml:"uptime-target"`
-		MinSpeedPerSecondString string  `yaml:"min-speed-per-second"`
+		MaxFailuresInARow       int               `yaml:"max-failures-in-a-row"`
+		MaxAuthFailuresInARow   int               `yaml:"max-auth-failures-in-a-row"`
+		UptimeTarget            float64           `yaml:"uptime-target"`
+		ErrorBudget             ErrorBudgetConfig `yaml:"error-budget"`
+		SampleGuardConfig       `yaml:",inline"`
+		MinSpeedPerSecondString string `yaml:"min-speed-per-second"`
 		MinBytesPerSecond       uint64
-		SpeedTarget             float64 `yaml:"speed-target"`
+		SpeedTarget             float64                 `yaml:"speed-target"`
+		SpeedPercentiles        []SpeedPercentileConfig `yaml:"speed-percentiles"`
+		PhaseTargets            []PhaseTargetConfig     `yaml:"phase-targets"`
+	}
+}
+
+// SpeedPercentileConfig is an SLO target for a percentile of download speeds, e.g. p10 above 1MB/s.
+type SpeedPercentileConfig struct {
+	Percentile              float64
+	MinSpeedPerSecondString string `yaml:"min-speed-per-second"`
+	MinBytesPerSecond       uint64
+}
+
+// parse parses our min speed.
+func (sp *SpeedPercentileConfig) parse() error {
+	err := checkPercentile(sp.Percentile)
+	if err != nil {
+		return err
+	}
+
+	sp.MinBytesPerSecond, err = bytefmt.ToBytes(sp.MinSpeedPerSecondString)
+	if err != nil {
+		return fmt.Errorf("Could not parse min-speed-per-second for p%v: [%s] %s", sp.Percentile, sp.MinSpeedPerSecondString, err.Error())
+	}
+
+	return nil
+}
+
+// RTTPercentileConfig is an SLO target for a percentile of RTTs, e.g. p95 under 150ms.
+type RTTPercentileConfig struct {
+	Percentile   float64
+	MaxRTTString string `yaml:"max-rtt"`
+	MaxRTT       time.Duration
+}
+
+// parse parses our max RTT.
+func (rp *RTTPercentileConfig) parse() error {
+	err := checkPercentile(rp.Percentile)
+	if err != nil {
+		return err
+	}
+
+	rp.MaxRTT, err = time.ParseDuration(rp.MaxRTTString)
+	if err != nil {
+		return fmt.Errorf("Could not parse max-rtt for p%v: %s", rp.Percentile, err.Error())
+	}
+
+	return nil
+}
+
+// checkPercentile confirms that the given percentile is between 0 and 100.
+func checkPercentile(percentile float64) error {
+	if percentile <= 0 || 100 < percentile {
+		return fmt.Errorf("Percentile [%v] must be between 0 and 100", percentile)
 	}
+	return nil
+}
+
+// PhaseTargetConfig is an SLO target for how long a single phase of a test download takes.
+type PhaseTargetConfig struct {
+	Phase         string
+	MaxTimeString string `yaml:"max-time"`
+	MaxTime       time.Duration
+	Target        float64
+}
+
+// parse confirms the phase exists and parses our max time.
+func (pt *PhaseTargetConfig) parse() error {
+	var phaseExists bool
+	for _, phase := range slo.DownloadPhases {
+		if pt.Phase == phase {
+			phaseExists = true
+		}
+	}
+	if !phaseExists {
+		return fmt.Errorf("Unknown phase [%s], must be one of: %s", pt.Phase, strings.Join(slo.DownloadPhases, ", "))
+	}
+
+	var err error
+	pt.MaxTime, err = time.ParseDuration(pt.MaxTimeString)
+	if err != nil {
+		return fmt.Errorf("Could not parse max-time for phase %s: %s", pt.Phase, err.Error())
+	}
+
+	if pt.Target <= 0 || 1 < pt.Target {
+		return fmt.Errorf("Target for phase %s must be between 0 and 1", pt.Phase)
+	}
+
+	return nil
+}
+
+// parse parses the sizes and durations in this test download.
+func (td *TestDownloadConfig) parse() error {
+	if td.URL == "" {
+		return errors.New("No url given")
+	}
+
+	err := td.HTTPAssertionsConfig.parse()
+	if err != nil {
+		return err
+	}
+	if len(td.StatusCodeStrings) < 1 {
+		td.StatusCodes = []StatusCodeRange{{Min: 200, Max: 299}}
+	}
+
+	td.SLO.HistoryRetained, err = time.ParseDuration(td.SLO.HistoryRetainedString)
+	if err != nil {
+		return fmt.Errorf("Could not parse history-retained: %s", err.Error())
+	}
+
+	err = td.SLO.ErrorBudget.parse()
+	if err != nil {
+		return fmt.Errorf("Invalid error-budget: %s", err.Error())
+	}
+
+	err = td.SLO.SampleGuardConfig.parse()
+	if err != nil {
+		return fmt.Errorf("Invalid SLO: %s", err.Error())
+	}
+
+	if td.MaxSizeToDLString != "" {
+		td.MaxBytesToDL, err = bytefmt.ToBytes(td.MaxSizeToDLString)
+		if err != nil {
+			return fmt.Errorf("Could not parse max-size-to-dl: %s", err.Error())
+		}
+	}
+
+	if td.SLO.MinSpeedPerSecondString != "" {
+		td.SLO.MinBytesPerSecond, err = bytefmt.ToBytes(td.SLO.MinSpeedPerSecondString)
+		if err != nil {
+			return fmt.Errorf("Could not parse min-speed-per-second: [%s] %s", td.SLO.MinSpeedPerSecondString, err.Error())
+		}
+	}
+
+	if td.SLO.MaxAuthFailuresInARow < 1 {
+		td.SLO.MaxAuthFailuresInARow = 2
+	}
+
+	for i := range td.SLO.SpeedPercentiles {
+		err = td.SLO.SpeedPercentiles[i].parse()
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := range td.SLO.PhaseTargets {
+		err = td.SLO.PhaseTargets[i].parse()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// EgressConfig is used to confirm that traffic through a proxy exits from the addresses we expect.
+type EgressConfig struct {
+	// URL returns the address it was requested from, as plain text or in JSON
+	URL             string
+	JSONPath        string `yaml:"json-path"`
+	ParsedJSONPath  *JSONPath
+	AllowedCIDRs    []string `yaml:"allowed-cidrs"`
+	AllowedNetworks []*net.IPNet
+	// RemoteDNS confirms that the proxy resolves the URL's hostname, rather than us
+	RemoteDNS bool `yaml:"remote-dns"`
+}
+
+// parse parses our JSONPath and allowed networks.
+func (ec *EgressConfig) parse() error {
+	u, err := url.Parse(ec.URL)
+	if err != nil {
+		return fmt.Errorf("Could not parse url: %s", err.Error())
+	}
+	if ec.RemoteDNS && net.ParseIP(u.Hostname()) != nil {
+		return errors.New("url must use a hostname to check remote-dns")
+	}
+
+	if ec.JSONPath != "" {
+		ec.ParsedJSONPath, err = ParseJSONPath(ec.JSONPath)
+		if err != nil {
+			return fmt.Errorf("Could not parse json-path: %s", err.Error())
+		}
+	}
+
+	if len(ec.AllowedCIDRs) < 1 {
+		return errors.New("No allowed-cidrs given")
+	}
+	ec.AllowedNetworks = nil
+	for _, cidr := range ec.AllowedCIDRs {
+		// single addresses are allowed too
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("Could not parse allowed-cidrs: %s", err.Error())
+		}
+		ec.AllowedNetworks = append(ec.AllowedNetworks, network)
+	}
+
+	return nil
 }
 
 // Socks5Config holds the monitor configuration for a SOCKS5 proxy.
 type Socks5Config struct {
 	Host                string
 	Port                int
+	Interval            string `yaml:"interval"`
+	IntervalDuration    time.Duration
+	Timeout             string `yaml:"timeout"`
+	TimeoutDuration     time.Duration
 	WaitBetweenAttempts int `yaml:"wait-between-attempts"`
 	Credentials         []UserPassCredentialConfig
 	TestDownload        TestDownloadConfig `yaml:"test-download"`
+	Egress              EgressConfig
+	Tags                []string
+	Notify              ServiceNotifyConfig
+}
+
+// HTTPProxyConfig holds the monitor configuration for an HTTP proxy.
+type HTTPProxyConfig struct {
+	Host                string
+	Port                int
+	Interval            string `yaml:"interval"`
+	IntervalDuration    time.Duration
+	Timeout             string `yaml:"timeout"`
+	TimeoutDuration     time.Duration
+	WaitBetweenAttempts int `yaml:"wait-between-attempts"`
+	Credentials         []UserPassCredentialConfig
+	TestDownload        TestDownloadConfig `yaml:"test-download"`
+	Tags                []string
+	Notify              ServiceNotifyConfig
+}
+
+// OpenVPNConfig holds the monitor configuration for an OpenVPN gateway.
+type OpenVPNConfig struct {
+	Host     string
+	Port     int
+	Protocol string
+	// CA, Cert and Key are paths to PEM files. The server's certificate is only verified if CA is set,
+	// and Cert and Key are only needed if the server requires client certificates.
+	CA   string `yaml:"ca"`
+	Cert string
+	Key  string
+	// TLSAuth and TLSCrypt are paths to static key files, for servers using tls-auth or tls-crypt.
+	TLSAuth             string `yaml:"tls-auth"`
+	TLSAuthKey          []byte
+	KeyDirection        *int `yaml:"key-direction"`
+	Auth                string
+	TLSCrypt            string `yaml:"tls-crypt"`
+	TLSCryptKey         []byte
+	ClientTLSConfig     *tls.Config
+	Interval            string `yaml:"interval"`
+	IntervalDuration    time.Duration
+	Timeout             string `yaml:"timeout"`
+	TimeoutDuration     time.Duration
+	WaitBetweenAttempts int `yaml:"wait-between-attempts"`
+	Credentials         []UserPassCredentialConfig
+	SLO                 struct {
+		HistoryRetainedString  string `yaml:"history-retained"`
+		HistoryRetained        time.Duration
+		MaxFailuresInARow      int               `yaml:"max-failures-in-a-row"`
+		MaxAuthFailuresInARow  int               `yaml:"max-auth-failures-in-a-row"`
+		UptimeTarget           float64           `yaml:"uptime-target"`
+		ErrorBudget            ErrorBudgetConfig `yaml:"error-budget"`
+		SampleGuardConfig      `yaml:",inline"`
+		MaxHandshakeTimeString string `yaml:"max-handshake-time"`
+		MaxHandshakeTime       time.Duration
+		HandshakeTimeTarget    float64 `yaml:"handshake-time-target"`
+	}
+	Tags   []string
+	Notify ServiceNotifyConfig
+}
+
+// WireGuardConfig holds the monitor configuration for a WireGuard endpoint.
+type WireGuardConfig struct {
+	Endpoint string
+	// PublicKey is the server's key, and PrivateKey is the key of the peer we connect as.
+	PublicKey           string `yaml:"public-key"`
+	ServerPublicKey     []byte
+	PrivateKey          string `yaml:"private-key"`
+	ClientPrivateKey    []byte
+	ClientPublicKey     []byte
+	PresharedKey        string `yaml:"preshared-key"`
+	PresharedKeyBytes   []byte
+	Interval            string `yaml:"interval"`
+	IntervalDuration    time.Duration
+	Timeout             string `yaml:"timeout"`
+	TimeoutDuration     time.Duration
+	WaitBetweenAttempts int `yaml:"wait-between-attempts"`
+	SLO                 struct {
+		HistoryRetainedString string `yaml:"history-retained"`
+		HistoryRetained       time.Duration
+		MaxFailuresInARow     int               `yaml:"max-failures-in-a-row"`
+		UptimeTarget          float64           `yaml:"uptime-target"`
+		ErrorBudget           ErrorBudgetConfig `yaml:"error-budget"`
+		SampleGuardConfig     `yaml:",inline"`
+		MaxRTTString          string `yaml:"max-rtt"`
+		MaxRTT                time.Duration
+		RTTTarget             float64 `yaml:"rtt-target"`
+	}
+	Tags   []string
+	Notify ServiceNotifyConfig
 }
 
 // PingConfig is the info for a test ping.
 type PingConfig struct {
 	Host                string
-	PingsPerRun         int `yaml:"pings-per-run"`
+	PingsPerRun         int    `yaml:"pings-per-run"`
+	Interval            string `yaml:"interval"`
+	IntervalDuration    time.Duration
+	Timeout             string `yaml:"timeout"`
+	TimeoutDuration     time.Duration
 	WaitBetweenAttempts int `yaml:"wait-between-attempts"`
 	SLO                 struct {
 		HistoryRetainedString string `yaml:"history-retained"`
 		HistoryRetained       time.Duration
-		MaxFailuresInARow     int     `yaml:"max-failures-in-a-row"`
-		UptimeTarget          float64 `yaml:"uptime-target"`
-		MaxRTTString          string  `yaml:"max-rtt"`
+		MaxFailuresInARow     int               `yaml:"max-failures-in-a-row"`
+		UptimeTarget          float64           `yaml:"uptime-target"`
+		ErrorBudget           ErrorBudgetConfig `yaml:"error-budget"`
+		SampleGuardConfig     `yaml:",inline"`
+		MaxRTTString          string `yaml:"max-rtt"`
 		MaxRTT                time.Duration
-		SpeedTarget           float64 `yaml:"speed-target"`
+		RTTTarget             float64 `yaml:"rtt-target"`
+		// SpeedTarget is the old name for RTTTarget.
+		SpeedTarget    float64               `yaml:"speed-target"`
+		RTTPercentiles []RTTPercentileConfig `yaml:"rtt-percentiles"`
+		// MaxJitter is the most that the RTTs of consecutive pings should differ by on average.
+		MaxJitterString string `yaml:"max-jitter"`
+		MaxJitter       time.Duration
 	}
+	Tags   []string
+	Notify ServiceNotifyConfig
+}
+
+// DNSConfig is the info for a DNS query made against a specific nameserver.
+type DNSConfig struct {
+	Nameserver string
+	Port       int
+	// Query is the name to look up, and Type is one of A, AAAA, CNAME, MX, TXT or SRV.
+	Query      string
+	Type       string
+	RecordType uint16
+	// Protocols are the transports to query over, udp and/or tcp.
+	Protocols []string
+	// Expected are the answers we must get back, in any order.
+	Expected            []string
+	MinRecords          int    `yaml:"min-records"`
+	Interval            string `yaml:"interval"`
+	IntervalDuration    time.Duration
+	Timeout             string `yaml:"timeout"`
+	TimeoutDuration     time.Duration
+	WaitBetweenAttempts int `yaml:"wait-between-attempts"`
+	SLO                 struct {
+		HistoryRetainedString string `yaml:"history-retained"`
+		HistoryRetained       time.Duration
+		MaxFailuresInARow     int               `yaml:"max-failures-in-a-row"`
+		UptimeTarget          float64           `yaml:"uptime-target"`
+		ErrorBudget           ErrorBudgetConfig `yaml:"error-budget"`
+		SampleGuardConfig     `yaml:",inline"`
+		MaxLatencyString      string `yaml:"max-latency"`
+		MaxLatency            time.Duration
+		LatencyTarget         float64 `yaml:"latency-target"`
+	}
+	Tags   []string
+	Notify ServiceNotifyConfig
+}
+
+// TCPConfig is the info for a TCP port check.
+type TCPConfig struct {
+	Host string
+	Port int
+	// Payload is sent once we're connected, before reading the banner.
+	Payload string
+	// BannerRegex is matched against what the server sends us, if set.
+	BannerRegex           string `yaml:"banner-regex"`
+	ParsedBannerRegex     *regexp.Regexp
+	BannerTimeout         string `yaml:"banner-timeout"`
+	BannerTimeoutDuration time.Duration
+	Interval              string `yaml:"interval"`
+	IntervalDuration      time.Duration
+	Timeout               string `yaml:"timeout"`
+	TimeoutDuration       time.Duration
+	WaitBetweenAttempts   int `yaml:"wait-between-attempts"`
+	SLO                   struct {
+		HistoryRetainedString string `yaml:"history-retained"`
+		HistoryRetained       time.Duration
+		MaxFailuresInARow     int               `yaml:"max-failures-in-a-row"`
+		UptimeTarget          float64           `yaml:"uptime-target"`
+		ErrorBudget           ErrorBudgetConfig `yaml:"error-budget"`
+		SampleGuardConfig     `yaml:",inline"`
+		MaxConnectTimeString  string `yaml:"max-connect-time"`
+		MaxConnectTime        time.Duration
+		ConnectTimeTarget     float64 `yaml:"connect-time-target"`
+	}
+	Tags   []string
+	Notify ServiceNotifyConfig
 }
 
 // Config holds the entire configuration for the service monitor.
@@ -113,16 +732,90 @@ type Config struct {
 
 	RecheckDelayDuration time.Duration
 
+	MaxConcurrency int `yaml:"max-concurrency"`
+
 	Ongoing OngoingConfig
 
+	Daemon DaemonConfig
+
 	Notify NotifyConfig
 
-	//TODO(dan): Possibly allow additional notify targets on specific services?
 	Services struct {
-		Webpage map[string]WebpageConfig
-		Socks5  map[string]Socks5Config
-		Ping    map[string]PingConfig
+		Webpage     map[string]WebpageConfig
+		JSONAPI     map[string]JSONAPIConfig `yaml:"json-api"`
+		Transaction map[string]TransactionConfig
+		TLS         map[string]TLSConfig
+		DNS         map[string]DNSConfig
+		TCP         map[string]TCPConfig
+		Socks5      map[string]Socks5Config
+		HTTPProxy   map[string]HTTPProxyConfig `yaml:"http-proxy"`
+		OpenVPN     map[string]OpenVPNConfig
+		WireGuard   map[string]WireGuardConfig
+		Ping        map[string]PingConfig
+	}
+}
+
+// defaultTimeout is how long checks can take if they don't have their own timeout set.
+const defaultTimeout = 30 * time.Second
+
+// defaultTLSWarningThresholds are used for TLS certificates that don't have their own thresholds set.
+var defaultTLSWarningThresholds = []string{"21d", "7d", "1d"}
+
+// parseLongDuration parses a duration, also accepting whole days like "30d".
+func parseLongDuration(duration string) (time.Duration, error) {
+	if strings.HasSuffix(duration, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(duration, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("Invalid number of days in [%s]", duration)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(duration)
+}
+
+// parseDurationWithDefault parses the given duration, returning the default if it's empty.
+func parseDurationWithDefault(duration string, defaultDuration time.Duration) (time.Duration, error) {
+	if duration == "" {
+		return defaultDuration, nil
 	}
+	return time.ParseDuration(duration)
+}
+
+// addTLSCheckForURL adds a TLS check for the given webpage's URL.
+func (config *Config) addTLSCheckForURL(name string, info WebpageConfig) error {
+	u, err := url.Parse(info.URL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" {
+		return fmt.Errorf("URL [%s] is not https", info.URL)
+	}
+
+	port := 443
+	if u.Port() != "" {
+		port, err = strconv.Atoi(u.Port())
+		if err != nil {
+			return err
+		}
+	}
+
+	tlsName := fmt.Sprintf("%s (TLS)", name)
+	if _, exists := config.Services.TLS[tlsName]; exists {
+		return fmt.Errorf("TLS %s already exists", tlsName)
+	}
+	if config.Services.TLS == nil {
+		config.Services.TLS = make(map[string]TLSConfig)
+	}
+	config.Services.TLS[tlsName] = TLSConfig{
+		Host:              u.Hostname(),
+		Port:              port,
+		Interval:          info.Interval,
+		Timeout:           info.Timeout,
+		WarningThresholds: info.TLSWarningThresholds,
+		Tags:              info.Tags,
+		Notify:            info.Notify,
+	}
+	return nil
 }
 
 // LoadConfig loads and returns the Config.
@@ -144,24 +837,185 @@ func LoadConfig(filename string) (*Config, error) {
 		return &config, fmt.Errorf("Could not parse RecheckDelay: %s", err.Error())
 	}
 
-	// calculate TestDownloadConfig stuff
-	for name, info := range config.Services.Socks5 {
-		info.TestDownload.SLO.HistoryRetained, err = time.ParseDuration(info.TestDownload.SLO.HistoryRetainedString)
+	if config.MaxConcurrency < 1 {
+		config.MaxConcurrency = 10
+	}
+
+	err = config.Ongoing.Flapping.parse()
+	if err != nil {
+		return &config, fmt.Errorf("Invalid flapping config in ongoing: %s", err.Error())
+	}
+
+	// get daemon durations
+	config.Daemon.DefaultInterval, err = parseDurationWithDefault(config.Daemon.DefaultIntervalString, time.Minute)
+	if err != nil {
+		return &config, fmt.Errorf("Could not parse default-interval in daemon: %s", err.Error())
+	}
+	config.Daemon.MaxJitter, err = parseDurationWithDefault(config.Daemon.MaxJitterString, 5*time.Second)
+	if err != nil {
+		return &config, fmt.Errorf("Could not parse max-jitter in daemon: %s", err.Error())
+	}
+	config.Daemon.FlushInterval, err = parseDurationWithDefault(config.Daemon.FlushIntervalString, time.Minute)
+	if err != nil {
+		return &config, fmt.Errorf("Could not parse flush-interval in daemon: %s", err.Error())
+	}
+
+	// calculate WebpageConfig stuff
+	for name, info := range config.Services.Webpage {
+		info.IntervalDuration, err = parseDurationWithDefault(info.Interval, config.Daemon.DefaultInterval)
+		if err != nil {
+			return &config, fmt.Errorf("Could not parse interval in Webpage %s: %s", name, err.Error())
+		}
+
+		info.TimeoutDuration, err = parseDurationWithDefault(info.Timeout, defaultTimeout)
 		if err != nil {
-			return &config, fmt.Errorf("Could not parse history-retained in SOCKS5 %s: %s", name, err.Error())
+			return &config, fmt.Errorf("Could not parse timeout in Webpage %s: %s", name, err.Error())
 		}
 
-		if info.TestDownload.MaxSizeToDLString != "" {
-			info.TestDownload.MaxBytesToDL, err = bytefmt.ToBytes(info.TestDownload.MaxSizeToDLString)
+		err = info.HTTPAssertionsConfig.parse()
+		if err != nil {
+			return &config, fmt.Errorf("Invalid assertions in Webpage %s: %s", name, err.Error())
+		}
+
+		// save new info
+		config.Services.Webpage[name] = info
+	}
+
+	// calculate JSONAPIConfig stuff
+	for name, info := range config.Services.JSONAPI {
+		info.IntervalDuration, err = parseDurationWithDefault(info.Interval, config.Daemon.DefaultInterval)
+		if err != nil {
+			return &config, fmt.Errorf("Could not parse interval in JSON API %s: %s", name, err.Error())
+		}
+
+		info.TimeoutDuration, err = parseDurationWithDefault(info.Timeout, defaultTimeout)
+		if err != nil {
+			return &config, fmt.Errorf("Could not parse timeout in JSON API %s: %s", name, err.Error())
+		}
+
+		err = info.HTTPAssertionsConfig.parse()
+		if err != nil {
+			return &config, fmt.Errorf("Invalid assertions in JSON API %s: %s", name, err.Error())
+		}
+
+		for i := range info.JSON {
+			err = info.JSON[i].parse()
 			if err != nil {
-				return &config, fmt.Errorf("Could not parse max-size-to-dl in SOCKS5 %s: %s", name, err.Error())
+				return &config, fmt.Errorf("Invalid JSON assertion in JSON API %s: %s", name, err.Error())
 			}
 		}
 
-		if info.TestDownload.SLO.MinSpeedPerSecondString != "" {
-			info.TestDownload.SLO.MinBytesPerSecond, err = bytefmt.ToBytes(info.TestDownload.SLO.MinSpeedPerSecondString)
+		// save new info
+		config.Services.JSONAPI[name] = info
+	}
+
+	// calculate TransactionConfig stuff
+	for name, info := range config.Services.Transaction {
+		info.IntervalDuration, err = parseDurationWithDefault(info.Interval, config.Daemon.DefaultInterval)
+		if err != nil {
+			return &config, fmt.Errorf("Could not parse interval in Transaction %s: %s", name, err.Error())
+		}
+
+		info.TimeoutDuration, err = parseDurationWithDefault(info.Timeout, defaultTimeout)
+		if err != nil {
+			return &config, fmt.Errorf("Could not parse timeout in Transaction %s: %s", name, err.Error())
+		}
+
+		if len(info.Steps) < 1 {
+			return &config, fmt.Errorf("Transaction %s has no steps", name)
+		}
+		for i := range info.Steps {
+			err = info.Steps[i].parse()
 			if err != nil {
-				return &config, fmt.Errorf("Could not parse min-speed-per-second in SOCKS5 %s: [%s] %s", name, info.TestDownload.SLO.MinSpeedPerSecondString, err.Error())
+				return &config, fmt.Errorf("Invalid step %d in Transaction %s: %s", i+1, name, err.Error())
+			}
+		}
+
+		// save new info
+		config.Services.Transaction[name] = info
+	}
+
+	// add TLS checks for webpages that want them
+	for name, info := range config.Services.Webpage {
+		if info.CheckTLS {
+			err = config.addTLSCheckForURL(name, info)
+			if err != nil {
+				return &config, fmt.Errorf("Could not add TLS check for Webpage %s: %s", name, err.Error())
+			}
+		}
+	}
+	for name, info := range config.Services.JSONAPI {
+		if info.CheckTLS {
+			err = config.addTLSCheckForURL(name, info.WebpageConfig)
+			if err != nil {
+				return &config, fmt.Errorf("Could not add TLS check for JSON API %s: %s", name, err.Error())
+			}
+		}
+	}
+
+	// calculate TLSConfig stuff
+	for name, info := range config.Services.TLS {
+		if info.Host == "" {
+			return &config, fmt.Errorf("TLS %s has no host", name)
+		}
+		if info.Port == 0 {
+			info.Port = 443
+		}
+		if info.ServerName == "" {
+			info.ServerName = info.Host
+		}
+
+		info.IntervalDuration, err = parseDurationWithDefault(info.Interval, config.Daemon.DefaultInterval)
+		if err != nil {
+			return &config, fmt.Errorf("Could not parse interval in TLS %s: %s", name, err.Error())
+		}
+
+		info.TimeoutDuration, err = parseDurationWithDefault(info.Timeout, defaultTimeout)
+		if err != nil {
+			return &config, fmt.Errorf("Could not parse timeout in TLS %s: %s", name, err.Error())
+		}
+
+		if len(info.WarningThresholds) < 1 {
+			info.WarningThresholds = defaultTLSWarningThresholds
+		}
+		info.WarningThresholdsDurations = nil
+		for _, threshold := range info.WarningThresholds {
+			thresholdDuration, err := parseLongDuration(threshold)
+			if err != nil {
+				return &config, fmt.Errorf("Could not parse warning-thresholds in TLS %s: %s", name, err.Error())
+			}
+			info.WarningThresholdsDurations = append(info.WarningThresholdsDurations, thresholdDuration)
+		}
+		// smallest first, so the first threshold we're under is the most urgent one
+		sort.Slice(info.WarningThresholdsDurations, func(i, j int) bool {
+			return info.WarningThresholdsDurations[i] < info.WarningThresholdsDurations[j]
+		})
+
+		// save new info
+		config.Services.TLS[name] = info
+	}
+
+	// calculate TestDownloadConfig stuff
+	for name, info := range config.Services.Socks5 {
+		info.IntervalDuration, err = parseDurationWithDefault(info.Interval, config.Daemon.DefaultInterval)
+		if err != nil {
+			return &config, fmt.Errorf("Could not parse interval in SOCKS5 %s: %s", name, err.Error())
+		}
+
+		info.TimeoutDuration, err = parseDurationWithDefault(info.Timeout, defaultTimeout)
+		if err != nil {
+			return &config, fmt.Errorf("Could not parse timeout in SOCKS5 %s: %s", name, err.Error())
+		}
+
+		err = info.TestDownload.parse()
+		if err != nil {
+			return &config, fmt.Errorf("Invalid test-download in SOCKS5 %s: %s", name, err.Error())
+		}
+
+		if info.Egress.URL != "" {
+			err = info.Egress.parse()
+			if err != nil {
+				return &config, fmt.Errorf("Invalid egress in SOCKS5 %s: %s", name, err.Error())
 			}
 		}
 
@@ -169,21 +1023,368 @@ func LoadConfig(filename string) (*Config, error) {
 		config.Services.Socks5[name] = info
 	}
 
+	// calculate HTTPProxyConfig stuff
+	for name, info := range config.Services.HTTPProxy {
+		if info.Host == "" || info.Port == 0 {
+			return &config, fmt.Errorf("HTTP proxy %s must have a host and port", name)
+		}
+
+		info.IntervalDuration, err = parseDurationWithDefault(info.Interval, config.Daemon.DefaultInterval)
+		if err != nil {
+			return &config, fmt.Errorf("Could not parse interval in HTTP proxy %s: %s", name, err.Error())
+		}
+
+		info.TimeoutDuration, err = parseDurationWithDefault(info.Timeout, defaultTimeout)
+		if err != nil {
+			return &config, fmt.Errorf("Could not parse timeout in HTTP proxy %s: %s", name, err.Error())
+		}
+
+		err = info.TestDownload.parse()
+		if err != nil {
+			return &config, fmt.Errorf("Invalid test-download in HTTP proxy %s: %s", name, err.Error())
+		}
+
+		if info.TestDownload.SLO.MaxFailuresInARow < 1 {
+			info.TestDownload.SLO.MaxFailuresInARow = 2
+		}
+
+		// save new info
+		config.Services.HTTPProxy[name] = info
+	}
+
+	// calculate OpenVPNConfig stuff
+	for name, info := range config.Services.OpenVPN {
+		err = info.parse()
+		if err != nil {
+			return &config, fmt.Errorf("Invalid config in OpenVPN %s: %s", name, err.Error())
+		}
+
+		info.IntervalDuration, err = parseDurationWithDefault(info.Interval, config.Daemon.DefaultInterval)
+		if err != nil {
+			return &config, fmt.Errorf("Could not parse interval in OpenVPN %s: %s", name, err.Error())
+		}
+
+		info.TimeoutDuration, err = parseDurationWithDefault(info.Timeout, defaultTimeout)
+		if err != nil {
+			return &config, fmt.Errorf("Could not parse timeout in OpenVPN %s: %s", name, err.Error())
+		}
+
+		info.SLO.HistoryRetained, err = time.ParseDuration(info.SLO.HistoryRetainedString)
+		if err != nil {
+			return &config, fmt.Errorf("Could not parse history-retained in OpenVPN %s: %s", name, err.Error())
+		}
+
+		err = info.SLO.ErrorBudget.parse()
+		if err != nil {
+			return &config, fmt.Errorf("Invalid error-budget in OpenVPN %s: %s", name, err.Error())
+		}
+
+		err = info.SLO.SampleGuardConfig.parse()
+		if err != nil {
+			return &config, fmt.Errorf("Invalid SLO in OpenVPN %s: %s", name, err.Error())
+		}
+
+		info.SLO.MaxHandshakeTime, err = time.ParseDuration(info.SLO.MaxHandshakeTimeString)
+		if err != nil {
+			return &config, fmt.Errorf("Could not parse max-handshake-time in OpenVPN %s: %s", name, err.Error())
+		}
+
+		if info.SLO.MaxFailuresInARow < 1 {
+			info.SLO.MaxFailuresInARow = 2
+		}
+		if info.SLO.MaxAuthFailuresInARow < 1 {
+			info.SLO.MaxAuthFailuresInARow = 2
+		}
+
+		// save new info
+		config.Services.OpenVPN[name] = info
+	}
+
+	// calculate WireGuardConfig stuff
+	for name, info := range config.Services.WireGuard {
+		err = info.parse()
+		if err != nil {
+			return &config, fmt.Errorf("Invalid config in WireGuard %s: %s", name, err.Error())
+		}
+
+		info.IntervalDuration, err = parseDurationWithDefault(info.Interval, config.Daemon.DefaultInterval)
+		if err != nil {
+			return &config, fmt.Errorf("Could not parse interval in WireGuard %s: %s", name, err.Error())
+		}
+
+		info.TimeoutDuration, err = parseDurationWithDefault(info.Timeout, defaultTimeout)
+		if err != nil {
+			return &config, fmt.Errorf("Could not parse timeout in WireGuard %s: %s", name, err.Error())
+		}
+
+		info.SLO.HistoryRetained, err = time.ParseDuration(info.SLO.HistoryRetainedString)
+		if err != nil {
+			return &config, fmt.Errorf("Could not parse history-retained in WireGuard %s: %s", name, err.Error())
+		}
+
+		err = info.SLO.ErrorBudget.parse()
+		if err != nil {
+			return &config, fmt.Errorf("Invalid error-budget in WireGuard %s: %s", name, err.Error())
+		}
+
+		err = info.SLO.SampleGuardConfig.parse()
+		if err != nil {
+			return &config, fmt.Errorf("Invalid SLO in WireGuard %s: %s", name, err.Error())
+		}
+
+		info.SLO.MaxRTT, err = time.ParseDuration(info.SLO.MaxRTTString)
+		if err != nil {
+			return &config, fmt.Errorf("Could not parse max-rtt in WireGuard %s: %s", name, err.Error())
+		}
+
+		if info.SLO.MaxFailuresInARow < 1 {
+			info.SLO.MaxFailuresInARow = 2
+		}
+
+		// save new info
+		config.Services.WireGuard[name] = info
+	}
+
 	// calculate PingConfig stuff
 	for name, info := range config.Services.Ping {
+		info.IntervalDuration, err = parseDurationWithDefault(info.Interval, config.Daemon.DefaultInterval)
+		if err != nil {
+			return &config, fmt.Errorf("Could not parse interval in Ping %s: %s", name, err.Error())
+		}
+
+		info.TimeoutDuration, err = parseDurationWithDefault(info.Timeout, defaultTimeout)
+		if err != nil {
+			return &config, fmt.Errorf("Could not parse timeout in Ping %s: %s", name, err.Error())
+		}
+
 		info.SLO.HistoryRetained, err = time.ParseDuration(info.SLO.HistoryRetainedString)
 		if err != nil {
 			return &config, fmt.Errorf("Could not parse history-retained in Ping %s: %s", name, err.Error())
 		}
 
+		err = info.SLO.ErrorBudget.parse()
+		if err != nil {
+			return &config, fmt.Errorf("Invalid error-budget in Ping %s: %s", name, err.Error())
+		}
+
+		err = info.SLO.SampleGuardConfig.parse()
+		if err != nil {
+			return &config, fmt.Errorf("Invalid SLO in Ping %s: %s", name, err.Error())
+		}
+
 		info.SLO.MaxRTT, err = time.ParseDuration(info.SLO.MaxRTTString)
 		if err != nil {
 			return &config, fmt.Errorf("Could not parse max-rtt in Ping %s: %s", name, err.Error())
 		}
 
+		if info.SLO.RTTTarget == 0 {
+			info.SLO.RTTTarget = info.SLO.SpeedTarget
+		}
+
+		for i := range info.SLO.RTTPercentiles {
+			err = info.SLO.RTTPercentiles[i].parse()
+			if err != nil {
+				return &config, fmt.Errorf("Invalid rtt-percentiles in Ping %s: %s", name, err.Error())
+			}
+		}
+
+		if info.SLO.MaxJitterString != "" {
+			info.SLO.MaxJitter, err = time.ParseDuration(info.SLO.MaxJitterString)
+			if err != nil {
+				return &config, fmt.Errorf("Could not parse max-jitter in Ping %s: %s", name, err.Error())
+			}
+		}
+
 		// save new info
 		config.Services.Ping[name] = info
 	}
 
+	// calculate DNSConfig stuff
+	for name, info := range config.Services.DNS {
+		err = info.parse()
+		if err != nil {
+			return &config, fmt.Errorf("Invalid config in DNS %s: %s", name, err.Error())
+		}
+
+		info.IntervalDuration, err = parseDurationWithDefault(info.Interval, config.Daemon.DefaultInterval)
+		if err != nil {
+			return &config, fmt.Errorf("Could not parse interval in DNS %s: %s", name, err.Error())
+		}
+
+		info.TimeoutDuration, err = parseDurationWithDefault(info.Timeout, defaultTimeout)
+		if err != nil {
+			return &config, fmt.Errorf("Could not parse timeout in DNS %s: %s", name, err.Error())
+		}
+
+		info.SLO.HistoryRetained, err = time.ParseDuration(info.SLO.HistoryRetainedString)
+		if err != nil {
+			return &config, fmt.Errorf("Could not parse history-retained in DNS %s: %s", name, err.Error())
+		}
+
+		err = info.SLO.ErrorBudget.parse()
+		if err != nil {
+			return &config, fmt.Errorf("Invalid error-budget in DNS %s: %s", name, err.Error())
+		}
+
+		err = info.SLO.SampleGuardConfig.parse()
+		if err != nil {
+			return &config, fmt.Errorf("Invalid SLO in DNS %s: %s", name, err.Error())
+		}
+
+		info.SLO.MaxLatency, err = time.ParseDuration(info.SLO.MaxLatencyString)
+		if err != nil {
+			return &config, fmt.Errorf("Could not parse max-latency in DNS %s: %s", name, err.Error())
+		}
+
+		if info.SLO.MaxFailuresInARow < 1 {
+			info.SLO.MaxFailuresInARow = 2
+		}
+
+		// save new info
+		config.Services.DNS[name] = info
+	}
+
+	// calculate TCPConfig stuff
+	for name, info := range config.Services.TCP {
+		if info.Host == "" || info.Port == 0 {
+			return &config, fmt.Errorf("TCP %s must have a host and port", name)
+		}
+
+		if info.BannerRegex != "" {
+			info.ParsedBannerRegex, err = regexp.Compile(info.BannerRegex)
+			if err != nil {
+				return &config, fmt.Errorf("Could not parse banner-regex in TCP %s: %s", name, err.Error())
+			}
+		}
+
+		info.BannerTimeoutDuration, err = parseDurationWithDefault(info.BannerTimeout, 5*time.Second)
+		if err != nil {
+			return &config, fmt.Errorf("Could not parse banner-timeout in TCP %s: %s", name, err.Error())
+		}
+
+		info.IntervalDuration, err = parseDurationWithDefault(info.Interval, config.Daemon.DefaultInterval)
+		if err != nil {
+			return &config, fmt.Errorf("Could not parse interval in TCP %s: %s", name, err.Error())
+		}
+
+		info.TimeoutDuration, err = parseDurationWithDefault(info.Timeout, defaultTimeout)
+		if err != nil {
+			return &config, fmt.Errorf("Could not parse timeout in TCP %s: %s", name, err.Error())
+		}
+
+		info.SLO.HistoryRetained, err = time.ParseDuration(info.SLO.HistoryRetainedString)
+		if err != nil {
+			return &config, fmt.Errorf("Could not parse history-retained in TCP %s: %s", name, err.Error())
+		}
+
+		err = info.SLO.ErrorBudget.parse()
+		if err != nil {
+			return &config, fmt.Errorf("Invalid error-budget in TCP %s: %s", name, err.Error())
+		}
+
+		err = info.SLO.SampleGuardConfig.parse()
+		if err != nil {
+			return &config, fmt.Errorf("Invalid SLO in TCP %s: %s", name, err.Error())
+		}
+
+		info.SLO.MaxConnectTime, err = time.ParseDuration(info.SLO.MaxConnectTimeString)
+		if err != nil {
+			return &config, fmt.Errorf("Could not parse max-connect-time in TCP %s: %s", name, err.Error())
+		}
+
+		if info.SLO.MaxFailuresInARow < 1 {
+			info.SLO.MaxFailuresInARow = 2
+		}
+
+		// save new info
+		config.Services.TCP[name] = info
+	}
+
+	// confirm our notifiers can actually send notifications
+	for name := range config.Notify.Notifiers {
+		_, exists := GetNotifier(name)
+		if !exists {
+			return &config, fmt.Errorf("Invalid notify config: Unknown notifier [%s]", name)
+		}
+	}
+	err = ValidateNotifiers(config.Notify, config.Notify.DefaultTargets)
+	if err != nil {
+		return &config, fmt.Errorf("Invalid notify config: %s", err.Error())
+	}
+
+	for i, route := range config.Notify.Routes {
+		err = route.validate(config.Notify)
+		if err != nil {
+			return &config, fmt.Errorf("Invalid notify route %d: %s", i+1, err.Error())
+		}
+	}
+
+	for name, info := range config.Services.Webpage {
+		err = info.Notify.validate(config.Notify)
+		if err != nil {
+			return &config, fmt.Errorf("Invalid notify config in Webpage %s: %s", name, err.Error())
+		}
+	}
+	for name, info := range config.Services.JSONAPI {
+		err = info.Notify.validate(config.Notify)
+		if err != nil {
+			return &config, fmt.Errorf("Invalid notify config in JSON API %s: %s", name, err.Error())
+		}
+	}
+	for name, info := range config.Services.Transaction {
+		err = info.Notify.validate(config.Notify)
+		if err != nil {
+			return &config, fmt.Errorf("Invalid notify config in Transaction %s: %s", name, err.Error())
+		}
+	}
+	for name, info := range config.Services.TLS {
+		err = info.Notify.validate(config.Notify)
+		if err != nil {
+			return &config, fmt.Errorf("Invalid notify config in TLS %s: %s", name, err.Error())
+		}
+	}
+	for name, info := range config.Services.Socks5 {
+		err = info.Notify.validate(config.Notify)
+		if err != nil {
+			return &config, fmt.Errorf("Invalid notify config in SOCKS5 %s: %s", name, err.Error())
+		}
+	}
+	for name, info := range config.Services.Ping {
+		err = info.Notify.validate(config.Notify)
+		if err != nil {
+			return &config, fmt.Errorf("Invalid notify config in Ping %s: %s", name, err.Error())
+		}
+	}
+	for name, info := range config.Services.HTTPProxy {
+		err = info.Notify.validate(config.Notify)
+		if err != nil {
+			return &config, fmt.Errorf("Invalid notify config in HTTP proxy %s: %s", name, err.Error())
+		}
+	}
+	for name, info := range config.Services.OpenVPN {
+		err = info.Notify.validate(config.Notify)
+		if err != nil {
+			return &config, fmt.Errorf("Invalid notify config in OpenVPN %s: %s", name, err.Error())
+		}
+	}
+	for name, info := range config.Services.WireGuard {
+		err = info.Notify.validate(config.Notify)
+		if err != nil {
+			return &config, fmt.Errorf("Invalid notify config in WireGuard %s: %s", name, err.Error())
+		}
+	}
+	for name, info := range config.Services.DNS {
+		err = info.Notify.validate(config.Notify)
+		if err != nil {
+			return &config, fmt.Errorf("Invalid notify config in DNS %s: %s", name, err.Error())
+		}
+	}
+	for name, info := range config.Services.TCP {
+		err = info.Notify.validate(config.Notify)
+		if err != nil {
+			return &config, fmt.Errorf("Invalid notify config in TCP %s: %s", name, err.Error())
+		}
+	}
+
 	return &config, nil
 }
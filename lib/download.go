@@ -0,0 +1,145 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/LondonTrustMedia/downtime_alert/lib/slo"
+)
+
+// checksBody returns true if our assertions need the body of the test download.
+func (td TestDownloadConfig) checksBody() bool {
+	return len(td.Matches) > 0 || len(td.MatchesRegex) > 0 || len(td.NotMatches) > 0
+}
+
+// phaseTimings collects how long each phase of a download took. Phases are timed from the dialer
+// and httptrace callbacks, which can run on the transport's goroutines, so access is locked.
+type phaseTimings struct {
+	lock    sync.Mutex
+	phases  map[string]time.Duration
+	started map[string]time.Time
+}
+
+// newPhaseTimings returns an empty phaseTimings.
+func newPhaseTimings() *phaseTimings {
+	return &phaseTimings{
+		phases:  make(map[string]time.Duration),
+		started: make(map[string]time.Time),
+	}
+}
+
+// Set records how long the given phase took.
+func (pt *phaseTimings) Set(phase string, elapsed time.Duration) {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+	pt.phases[phase] = elapsed
+}
+
+// Start marks the given phase as starting now.
+func (pt *phaseTimings) Start(phase string) {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+	pt.started[phase] = time.Now()
+}
+
+// Finish records how long the given phase took since it was started.
+func (pt *phaseTimings) Finish(phase string) {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+	if startedTime, started := pt.started[phase]; started {
+		pt.phases[phase] = time.Since(startedTime)
+	}
+}
+
+// Phases returns a copy of the recorded phases.
+func (pt *phaseTimings) Phases() map[string]time.Duration {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+	phases := make(map[string]time.Duration, len(pt.phases))
+	for phase, elapsed := range pt.phases {
+		phases[phase] = elapsed
+	}
+	return phases
+}
+
+// testDownload downloads our test file with the given client, checks the response against our
+// assertions and returns the size and speed of the download. The speed only covers reading the body,
+// so connecting and waiting for the response isn't counted against it. The first-byte and transfer
+// phases are timed and added to phases.
+func testDownload(ctx context.Context, client *http.Client, config TestDownloadConfig, phases *phaseTimings) (uint64, uint64, error) {
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			phases.Start(slo.PhaseFirstByte)
+		},
+		GotFirstResponseByte: func() {
+			phases.Finish(slo.PhaseFirstByte)
+		},
+	})
+
+	req, err := http.NewRequestWithContext(ctx, "GET", replaceVariables(config.URL, nil), nil)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Could not create request: %s", err.Error())
+	}
+	if config.MaxBytesToDL > 0 {
+		req.Header.Add("Range", fmt.Sprintf("bytes=0-%d", config.MaxBytesToDL-1))
+	}
+
+	requestStartedTime := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, 0, classifyRequestError(ctx, err)
+	}
+	defer resp.Body.Close()
+
+	err = config.checkStatusCode(resp)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// servers that ignore our range request still only get read up to max-size-to-dl
+	var body io.Reader = resp.Body
+	if config.MaxBytesToDL > 0 {
+		body = io.LimitReader(body, int64(config.MaxBytesToDL))
+	}
+	if config.MaxBodyBytes > 0 {
+		body = io.LimitReader(body, int64(config.MaxBodyBytes)+1)
+	}
+
+	// we only keep the body around if we need to check it
+	var bodyBuffer bytes.Buffer
+	var output io.Writer = ioutil.Discard
+	if config.checksBody() {
+		output = &bodyBuffer
+	}
+
+	downloadStartedTime := time.Now()
+	downloadSizeBytes, err := io.Copy(output, body)
+	if err != nil {
+		return 0, 0, checkTimeout(ctx, fmt.Errorf("Could not read response body: %w", err))
+	}
+	downloadElapsed := time.Since(downloadStartedTime)
+	phases.Set(slo.PhaseTransfer, downloadElapsed)
+
+	if config.MaxBodyBytes > 0 && uint64(downloadSizeBytes) > config.MaxBodyBytes {
+		return 0, 0, fmt.Errorf("Body is larger than max-body-size of %s", bytefmt.ByteSize(config.MaxBodyBytes))
+	}
+	err = config.checkResponse(resp, bodyBuffer.Bytes(), time.Since(requestStartedTime))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// tiny downloads can finish within the clock's resolution
+	if downloadElapsed < time.Millisecond {
+		downloadElapsed = time.Millisecond
+	}
+	bytesPerSecond := uint64(float64(downloadSizeBytes) / downloadElapsed.Seconds())
+	return uint64(downloadSizeBytes), bytesPerSecond, nil
+}
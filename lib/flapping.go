@@ -0,0 +1,113 @@
+package lib
+
+import (
+	"fmt"
+
+	"github.com/tidwall/buntdb"
+)
+
+const (
+	keyFlapStates = "ongoing.flap.states %s %s"
+	keyFlapping   = "ongoing.flapping %s %s"
+)
+
+// FlapState says whether a service is flapping, and whether that just changed.
+type FlapState int
+
+const (
+	// NotFlapping services are alerted about as normal.
+	NotFlapping FlapState = iota
+	// FlapStarted is returned once, when a service starts flapping.
+	FlapStarted
+	// FlapOngoing is returned while a service keeps flapping.
+	FlapOngoing
+	// FlapStopped is returned once, when a flapping service stabilises.
+	FlapStopped
+)
+
+// FlapStatus describes whether a service is flapping, and how often its state has been changing.
+type FlapStatus struct {
+	State FlapState
+	// StateChange is the weighted fraction of checks where the state changed, see stateChange.
+	StateChange float64
+	Checks      int
+}
+
+// Flapping returns true if individual up and down alerts should be suppressed.
+func (fs FlapStatus) Flapping() bool {
+	return fs.State != NotFlapping
+}
+
+// Changed returns true if the service just started or stopped flapping.
+func (fs FlapStatus) Changed() bool {
+	return fs.State == FlapStarted || fs.State == FlapStopped
+}
+
+// RecordFlapping records whether the given service is up, and returns whether it's flapping.
+func RecordFlapping(db *buntdb.DB, config FlapConfig, section, name string, up bool) FlapStatus {
+	var status FlapStatus
+	if config.Disable {
+		return status
+	}
+
+	flapStatesKey := fmt.Sprintf(keyFlapStates, section, name)
+	flappingKey := fmt.Sprintf(keyFlapping, section, name)
+	err := db.Update(func(tx *buntdb.Tx) error {
+		// err doesn't matter here, we just start with an empty history
+		states, _ := tx.Get(flapStatesKey)
+		if up {
+			states += "u"
+		} else {
+			states += "d"
+		}
+		if config.Window < len(states) {
+			states = states[len(states)-config.Window:]
+		}
+		tx.Set(flapStatesKey, states, nil)
+
+		status.StateChange = stateChange(states)
+		status.Checks = len(states)
+
+		_, err := tx.Get(flappingKey)
+		if err == nil {
+			if status.StateChange < config.LowThreshold {
+				status.State = FlapStopped
+				tx.Delete(flappingKey)
+			} else {
+				status.State = FlapOngoing
+			}
+		} else if len(states) == config.Window && config.HighThreshold < status.StateChange {
+			status.State = FlapStarted
+			tx.Set(flappingKey, "1", nil)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		fmt.Println("Couldn't write update:", err.Error())
+	}
+	return status
+}
+
+// stateChange returns the fraction of the given states that are different from the one before, like
+// Nagios' percent state change. Recent changes are weighted more heavily than older ones, from 0.8
+// for the oldest to 1.2 for the newest.
+func stateChange(states string) float64 {
+	if len(states) < 2 {
+		return 0
+	}
+
+	var changes float64
+	for i := 1; i < len(states); i++ {
+		if states[i] == states[i-1] {
+			continue
+		}
+		weight := 1.0
+		if 2 < len(states) {
+			weight = 0.8 + 0.4*float64(i-1)/float64(len(states)-2)
+		}
+		changes += weight
+	}
+	return changes / float64(len(states)-1)
+}
@@ -0,0 +1,232 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+)
+
+// StatusCodeRange is an inclusive range of acceptable HTTP status codes.
+type StatusCodeRange struct {
+	Min int
+	Max int
+}
+
+// parseStatusCodeRange parses status codes like "200", "200-299" or "2xx".
+func parseStatusCodeRange(codes string) (StatusCodeRange, error) {
+	codes = strings.TrimSpace(strings.ToLower(codes))
+
+	if len(codes) == 3 && strings.HasSuffix(codes, "xx") {
+		hundreds, err := strconv.Atoi(codes[:1])
+		if err != nil {
+			return StatusCodeRange{}, err
+		}
+		return StatusCodeRange{Min: hundreds * 100, Max: hundreds*100 + 99}, nil
+	}
+
+	if strings.Contains(codes, "-") {
+		parts := strings.SplitN(codes, "-", 2)
+		min, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil {
+			return StatusCodeRange{}, err
+		}
+		max, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return StatusCodeRange{}, err
+		}
+		return StatusCodeRange{Min: min, Max: max}, nil
+	}
+
+	code, err := strconv.Atoi(codes)
+	if err != nil {
+		return StatusCodeRange{}, err
+	}
+	return StatusCodeRange{Min: code, Max: code}, nil
+}
+
+// HTTPRequestConfig holds the details of the HTTP request to make.
+type HTTPRequestConfig struct {
+	Method         string
+	RequestHeaders map[string]string `yaml:"request-headers"`
+	Body           string
+}
+
+// newRequest returns a new request for the given URL.
+func (hrc HTTPRequestConfig) newRequest(ctx context.Context, url string) (*http.Request, error) {
+	method := hrc.Method
+	if method == "" {
+		method = "GET"
+	}
+
+	var body io.Reader
+	if hrc.Body != "" {
+		body = strings.NewReader(hrc.Body)
+	}
+
+	req, err := http.NewRequest(strings.ToUpper(method), url, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	for name, value := range hrc.RequestHeaders {
+		req.Header.Set(name, value)
+	}
+
+	return req, nil
+}
+
+// HeaderAssertionConfig is a check made against a response header.
+type HeaderAssertionConfig struct {
+	Name          string
+	MatchesString string `yaml:"matches"`
+	MatchesRegex  *regexp.Regexp
+	Absent        bool
+}
+
+// HTTPAssertionsConfig holds the checks made against an HTTP response.
+type HTTPAssertionsConfig struct {
+	StatusCodeStrings     []string `yaml:"status-codes"`
+	StatusCodes           []StatusCodeRange
+	Matches               []string
+	MatchesRegexStrings   []string `yaml:"matches-regex"`
+	MatchesRegex          []*regexp.Regexp
+	NotMatches            []string `yaml:"not-matches"`
+	Headers               []HeaderAssertionConfig
+	MaxBodySizeString     string `yaml:"max-body-size"`
+	MaxBodyBytes          uint64
+	MaxResponseTimeString string `yaml:"max-response-time"`
+	MaxResponseTime       time.Duration
+}
+
+// parse calculates the parsed versions of our config strings.
+func (hac *HTTPAssertionsConfig) parse() error {
+	var err error
+
+	hac.StatusCodes = nil
+	for _, codes := range hac.StatusCodeStrings {
+		statusCodes, err := parseStatusCodeRange(codes)
+		if err != nil {
+			return fmt.Errorf("Could not parse status-codes [%s]: %s", codes, err.Error())
+		}
+		hac.StatusCodes = append(hac.StatusCodes, statusCodes)
+	}
+	if len(hac.StatusCodes) < 1 {
+		hac.StatusCodes = []StatusCodeRange{{Min: http.StatusOK, Max: http.StatusOK}}
+	}
+
+	hac.MatchesRegex = nil
+	for _, expr := range hac.MatchesRegexStrings {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("Could not parse matches-regex [%s]: %s", expr, err.Error())
+		}
+		hac.MatchesRegex = append(hac.MatchesRegex, re)
+	}
+
+	for i, header := range hac.Headers {
+		if header.Name == "" {
+			return fmt.Errorf("Header assertion %d has no name", i+1)
+		}
+		if header.MatchesString != "" {
+			hac.Headers[i].MatchesRegex, err = regexp.Compile(header.MatchesString)
+			if err != nil {
+				return fmt.Errorf("Could not parse matches for header %s [%s]: %s", header.Name, header.MatchesString, err.Error())
+			}
+		}
+	}
+
+	if hac.MaxBodySizeString != "" {
+		hac.MaxBodyBytes, err = bytefmt.ToBytes(hac.MaxBodySizeString)
+		if err != nil {
+			return fmt.Errorf("Could not parse max-body-size: %s", err.Error())
+		}
+	}
+
+	hac.MaxResponseTime, err = parseDurationWithDefault(hac.MaxResponseTimeString, 0)
+	if err != nil {
+		return fmt.Errorf("Could not parse max-response-time: %s", err.Error())
+	}
+
+	return nil
+}
+
+// readResponseBody reads the response body, returning an error if it's larger than maxBytes (if set).
+func readResponseBody(body io.Reader, maxBytes uint64) ([]byte, error) {
+	if maxBytes > 0 {
+		body = io.LimitReader(body, int64(maxBytes)+1)
+	}
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return data, fmt.Errorf("Could not read response body: %w", err)
+	}
+	if maxBytes > 0 && uint64(len(data)) > maxBytes {
+		return data, fmt.Errorf("Body is larger than max-body-size of %s", bytefmt.ByteSize(maxBytes))
+	}
+	return data, nil
+}
+
+// checkStatusCode returns an error if the response's status code isn't accepted.
+func (hac HTTPAssertionsConfig) checkStatusCode(resp *http.Response) error {
+	for _, codes := range hac.StatusCodes {
+		if codes.Min <= resp.StatusCode && resp.StatusCode <= codes.Max {
+			return nil
+		}
+	}
+	return fmt.Errorf("Status: %s", resp.Status)
+}
+
+// checkResponse returns an error describing the first assertion that the response fails.
+// The status code and body size are checked separately, as they're checked before the body is read.
+func (hac HTTPAssertionsConfig) checkResponse(resp *http.Response, body []byte, responseTime time.Duration) error {
+	for _, header := range hac.Headers {
+		values, exists := resp.Header[http.CanonicalHeaderKey(header.Name)]
+		if header.Absent {
+			if exists {
+				return fmt.Errorf("Header %s was present but should be absent", header.Name)
+			}
+			continue
+		}
+		if !exists {
+			return fmt.Errorf("Header %s was missing", header.Name)
+		}
+		if header.MatchesRegex != nil && !header.MatchesRegex.MatchString(strings.Join(values, ", ")) {
+			return fmt.Errorf("Header %s [%s] did not match [%s]", header.Name, strings.Join(values, ", "), header.MatchesString)
+		}
+	}
+
+	bodyString := string(body)
+
+	for _, m := range hac.Matches {
+		if !strings.Contains(bodyString, m) {
+			return fmt.Errorf("Body did not contain required string [%s]", m)
+		}
+	}
+
+	for _, re := range hac.MatchesRegex {
+		if !re.MatchString(bodyString) {
+			return fmt.Errorf("Body did not match required regex [%s]", re.String())
+		}
+	}
+
+	for _, m := range hac.NotMatches {
+		if strings.Contains(bodyString, m) {
+			return fmt.Errorf("Body contained forbidden string [%s]", m)
+		}
+	}
+
+	if hac.MaxResponseTime > 0 && hac.MaxResponseTime < responseTime {
+		return fmt.Errorf("Response took %s, longer than max-response-time of %s", responseTime, hac.MaxResponseTime)
+	}
+
+	return nil
+}
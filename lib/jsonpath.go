@@ -0,0 +1,110 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// jsonPathStep is a single step in a JSONPath, either an object key or an array index.
+type jsonPathStep struct {
+	key     string
+	index   int
+	isIndex bool
+}
+
+// JSONPath is a parsed JSONPath expression. We support the subset that's useful for health
+// checks: $, .key, ['key'] and [index], where negative indexes count from the end of the array.
+type JSONPath struct {
+	expression string
+	steps      []jsonPathStep
+}
+
+// ParseJSONPath parses the given JSONPath expression.
+func ParseJSONPath(expression string) (*JSONPath, error) {
+	path := &JSONPath{
+		expression: expression,
+	}
+
+	remaining := strings.TrimSpace(expression)
+	if !strings.HasPrefix(remaining, "$") {
+		return nil, errors.New("JSONPath must start with $")
+	}
+	remaining = remaining[1:]
+
+	for len(remaining) > 0 {
+		switch remaining[0] {
+		case '.':
+			remaining = remaining[1:]
+			end := strings.IndexAny(remaining, ".[")
+			if end == -1 {
+				end = len(remaining)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("Empty key in JSONPath %s", expression)
+			}
+			path.steps = append(path.steps, jsonPathStep{key: remaining[:end]})
+			remaining = remaining[end:]
+		case '[':
+			end := strings.Index(remaining, "]")
+			if end == -1 {
+				return nil, fmt.Errorf("Unclosed [ in JSONPath %s", expression)
+			}
+			inner := strings.TrimSpace(remaining[1:end])
+			remaining = remaining[end+1:]
+
+			if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				path.steps = append(path.steps, jsonPathStep{key: inner[1 : len(inner)-1]})
+				continue
+			}
+
+			index, err := strconv.Atoi(inner)
+			if err != nil {
+				return nil, fmt.Errorf("Bad index [%s] in JSONPath %s", inner, expression)
+			}
+			path.steps = append(path.steps, jsonPathStep{index: index, isIndex: true})
+		default:
+			return nil, fmt.Errorf("Unexpected character %q in JSONPath %s", remaining[0], expression)
+		}
+	}
+
+	return path, nil
+}
+
+// String returns the original JSONPath expression.
+func (path *JSONPath) String() string {
+	return path.expression
+}
+
+// Lookup returns the value at this path in the given decoded JSON, and whether it exists.
+func (path *JSONPath) Lookup(data interface{}) (interface{}, bool) {
+	current := data
+	for _, step := range path.steps {
+		if step.isIndex {
+			array, isArray := current.([]interface{})
+			if !isArray {
+				return nil, false
+			}
+			index := step.index
+			if index < 0 {
+				index += len(array)
+			}
+			if index < 0 || len(array) <= index {
+				return nil, false
+			}
+			current = array[index]
+		} else {
+			object, isObject := current.(map[string]interface{})
+			if !isObject {
+				return nil, false
+			}
+			var exists bool
+			current, exists = object[step.key]
+			if !exists {
+				return nil, false
+			}
+		}
+	}
+	return current, true
+}
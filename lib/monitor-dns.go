@@ -0,0 +1,193 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LondonTrustMedia/downtime_alert/lib/slo"
+	"github.com/miekg/dns"
+)
+
+// dnsRecordTypes are the record types we can check.
+var dnsRecordTypes = map[string]uint16{
+	"A":     dns.TypeA,
+	"AAAA":  dns.TypeAAAA,
+	"CNAME": dns.TypeCNAME,
+	"MX":    dns.TypeMX,
+	"TXT":   dns.TypeTXT,
+	"SRV":   dns.TypeSRV,
+}
+
+// normaliseDNSName lowercases the given name and removes its trailing dot.
+func normaliseDNSName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// parse checks our record type and protocols, and normalises our expected answers.
+func (config *DNSConfig) parse() error {
+	if config.Nameserver == "" {
+		return errors.New("No nameserver given")
+	}
+	if config.Query == "" {
+		return errors.New("No query given")
+	}
+	if config.Port == 0 {
+		config.Port = 53
+	}
+
+	config.Type = strings.ToUpper(config.Type)
+	if config.Type == "" {
+		config.Type = "A"
+	}
+	var exists bool
+	config.RecordType, exists = dnsRecordTypes[config.Type]
+	if !exists {
+		return fmt.Errorf("Record type %s is not supported", config.Type)
+	}
+
+	if len(config.Protocols) < 1 {
+		config.Protocols = []string{"udp"}
+	}
+	for i, protocol := range config.Protocols {
+		protocol = strings.ToLower(protocol)
+		if protocol != "udp" && protocol != "tcp" {
+			return fmt.Errorf("Protocol %s is not supported, must be udp or tcp", protocol)
+		}
+		config.Protocols[i] = protocol
+	}
+
+	for i, answer := range config.Expected {
+		config.Expected[i] = normaliseDNSAnswer(config.Type, answer)
+	}
+
+	return nil
+}
+
+// normaliseDNSAnswer normalises an answer from our config so it can be compared against dnsAnswer.
+func normaliseDNSAnswer(recordType, answer string) string {
+	switch recordType {
+	case "A", "AAAA":
+		ip := net.ParseIP(answer)
+		if ip != nil {
+			return ip.String()
+		}
+	case "CNAME":
+		return normaliseDNSName(answer)
+	case "MX", "SRV":
+		// the name is always the last field
+		fields := strings.Fields(answer)
+		if len(fields) > 0 {
+			fields[len(fields)-1] = normaliseDNSName(fields[len(fields)-1])
+		}
+		return strings.Join(fields, " ")
+	}
+	return answer
+}
+
+// dnsAnswer returns the given record as a string, in the same format as the expected answers in our config:
+//
+//	A, AAAA: the address, e.g. 192.0.2.1
+//	CNAME:   the target, e.g. vpn.example.com
+//	MX:      preference then host, e.g. 10 mail.example.com
+//	TXT:     the text, with multiple strings joined together
+//	SRV:     priority, weight, port then target, e.g. 10 5 1194 vpn.example.com
+func dnsAnswer(rr dns.RR) string {
+	switch record := rr.(type) {
+	case *dns.A:
+		return record.A.String()
+	case *dns.AAAA:
+		return record.AAAA.String()
+	case *dns.CNAME:
+		return normaliseDNSName(record.Target)
+	case *dns.MX:
+		return fmt.Sprintf("%d %s", record.Preference, normaliseDNSName(record.Mx))
+	case *dns.TXT:
+		return strings.Join(record.Txt, "")
+	case *dns.SRV:
+		return fmt.Sprintf("%d %d %d %s", record.Priority, record.Weight, record.Port, normaliseDNSName(record.Target))
+	}
+	return rr.String()
+}
+
+// queryDNS makes our query over the given protocol, checks the answers and returns how long the query took.
+func queryDNS(ctx context.Context, config DNSConfig, protocol string) (time.Duration, error) {
+	client := &dns.Client{
+		Net: protocol,
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(config.Query), config.RecordType)
+
+	resp, rtt, err := client.ExchangeContext(ctx, msg, net.JoinHostPort(config.Nameserver, strconv.Itoa(config.Port)))
+	if err != nil {
+		return 0, checkTimeout(ctx, err)
+	}
+
+	switch resp.Rcode {
+	case dns.RcodeSuccess:
+	case dns.RcodeNameError:
+		return rtt, fmt.Errorf("NXDOMAIN: %s does not exist", config.Query)
+	case dns.RcodeServerFailure:
+		return rtt, errors.New("SERVFAIL: Nameserver could not answer the query")
+	default:
+		return rtt, fmt.Errorf("Nameserver returned %s", dns.RcodeToString[resp.Rcode])
+	}
+
+	// CNAMEs can be returned along with the records we asked for, so only look at the right type
+	var answers []string
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype == config.RecordType {
+			answers = append(answers, dnsAnswer(rr))
+		}
+	}
+	sort.Strings(answers)
+
+	if len(answers) < config.MinRecords {
+		return rtt, fmt.Errorf("Got %d %s records, expected at least %d", len(answers), config.Type, config.MinRecords)
+	}
+
+	if len(config.Expected) > 0 {
+		expected := make([]string, len(config.Expected))
+		copy(expected, config.Expected)
+		sort.Strings(expected)
+
+		if strings.Join(answers, "\n") != strings.Join(expected, "\n") {
+			return rtt, fmt.Errorf("Answers did not match\nExpected: %s\nGot: %s", strings.Join(expected, ", "), strings.Join(answers, ", "))
+		}
+	}
+
+	return rtt, nil
+}
+
+// CheckDNS queries the given nameserver over each protocol and tracks results in the tracker. It returns
+// the last failure we saw, if any.
+func CheckDNS(ctx context.Context, tracker *slo.PingTracker, config DNSConfig) error {
+	log.Println("Checking DNS", config.Type, "record for", config.Query, "on", config.Nameserver)
+
+	var lastErr error
+
+	for _, protocol := range config.Protocols {
+		rtt, err := queryDNS(ctx, config, protocol)
+		if IsTimeout(err) {
+			tracker.AddTimeout(time.Now(), fmt.Sprintf("%s: %s", strings.ToUpper(protocol), err.Error()))
+		} else if err != nil {
+			tracker.AddFailure(time.Now(), fmt.Sprintf("%s: %s", strings.ToUpper(protocol), err.Error()))
+		} else {
+			tracker.AddPing(time.Now(), rtt)
+			log.Println("Queried", config.Nameserver, "over", strings.ToUpper(protocol), "in", rtt)
+		}
+
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %w", strings.ToUpper(protocol), err)
+		}
+	}
+
+	return lastErr
+}
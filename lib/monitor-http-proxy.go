@@ -0,0 +1,105 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/LondonTrustMedia/downtime_alert/lib/slo"
+)
+
+// CheckHTTPProxy checks the given HTTP proxy and returns an error if it doesn't work. Plain HTTP
+// test downloads are requested through the proxy directly, and HTTPS ones are tunnelled with CONNECT.
+func CheckHTTPProxy(ctx context.Context, tracker *slo.DownloadTracker, config HTTPProxyConfig, credsToUse int) error {
+	log.Println("Checking HTTP proxy", config.Host)
+
+	// credentials are sent in Proxy-Authorization
+	proxyURL := &url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort(config.Host, strconv.Itoa(config.Port)),
+	}
+	var username string
+	if len(config.Credentials) > 0 {
+		username = config.Credentials[credsToUse].Username
+		proxyURL.User = url.UserPassword(username, config.Credentials[credsToUse].Password)
+	}
+
+	// the proxy rejects our credentials in the CONNECT response for HTTPS, and in the response itself for HTTP
+	client := &http.Client{
+		Transport: &proxyAuthTransport{
+			RoundTripper: &http.Transport{
+				Proxy:             http.ProxyURL(proxyURL),
+				DisableKeepAlives: true,
+				OnProxyConnectResponse: func(ctx context.Context, proxyURL *url.URL, connectReq *http.Request, connectRes *http.Response) error {
+					return proxyAuthError(connectRes, username)
+				},
+			},
+			username: username,
+		},
+	}
+
+	// we can time connecting to the proxy, but authentication and CONNECT all happen in one request
+	phases := newPhaseTimings()
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		ConnectStart: func(network, addr string) {
+			phases.Start(slo.PhaseProxyConnect)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			if err == nil {
+				phases.Finish(slo.PhaseProxyConnect)
+			}
+		},
+	})
+
+	downloadStartedTime := time.Now()
+	downloadSizeBytes, downloadSpeedBytesPerSecond, err := testDownload(ctx, client, config.TestDownload, phases)
+	if err != nil {
+		return err
+	}
+
+	log.Println("HTTP proxy", config.Host, "- Downloaded", bytefmt.ByteSize(downloadSizeBytes), "--", fmt.Sprintf("%s/s", bytefmt.ByteSize(downloadSpeedBytesPerSecond)))
+
+	tracker.AddDownload(downloadStartedTime, downloadSpeedBytesPerSecond, phases.Phases())
+
+	// no errors!
+	return nil
+}
+
+// proxyAuthTransport turns responses saying that the proxy rejected our credentials into errors.
+type proxyAuthTransport struct {
+	http.RoundTripper
+	username string
+}
+
+// RoundTrip makes the given request, and returns a RequestError if the proxy rejected our credentials.
+func (t *proxyAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	err = proxyAuthError(resp, t.username)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+// proxyAuthError returns a RequestError if the given response is the proxy rejecting our credentials.
+func proxyAuthError(resp *http.Response, username string) error {
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		return nil
+	}
+	if username == "" {
+		return &RequestError{Category: RequestErrorAuth, Err: errors.New("Proxy requires a credential")}
+	}
+	return &RequestError{Category: RequestErrorAuth, Err: fmt.Errorf("Proxy rejected credential %s", username)}
+}
@@ -0,0 +1,160 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// JSONAssertionConfig is a check made against a value in a JSON response.
+type JSONAssertionConfig struct {
+	Path        string
+	ParsedPath  *JSONPath
+	Exists      *bool
+	Equals      interface{}
+	LessThan    *float64 `yaml:"less-than"`
+	GreaterThan *float64 `yaml:"greater-than"`
+	Length      *int
+	MinLength   *int `yaml:"min-length"`
+	MaxLength   *int `yaml:"max-length"`
+}
+
+// normaliseJSONScalar converts numbers to float64 so values from our config and from decoded
+// JSON can be compared. It returns false if the value isn't a string, number or boolean.
+func normaliseJSONScalar(value interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case string, bool, float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	}
+	return nil, false
+}
+
+// parse parses our JSONPath and confirms that our values make sense.
+func (jac *JSONAssertionConfig) parse() error {
+	var err error
+	jac.ParsedPath, err = ParseJSONPath(jac.Path)
+	if err != nil {
+		return err
+	}
+
+	if jac.Equals != nil {
+		var isScalar bool
+		jac.Equals, isScalar = normaliseJSONScalar(jac.Equals)
+		if !isScalar {
+			return fmt.Errorf("equals for %s must be a string, number or boolean", jac.Path)
+		}
+	}
+
+	if jac.Exists != nil && !*jac.Exists && (jac.Equals != nil || jac.LessThan != nil || jac.GreaterThan != nil || jac.Length != nil || jac.MinLength != nil || jac.MaxLength != nil) {
+		return fmt.Errorf("%s can't be checked if it must not exist", jac.Path)
+	}
+
+	return nil
+}
+
+// jsonLength returns the length of the given array, object or string.
+func jsonLength(value interface{}) (int, error) {
+	switch v := value.(type) {
+	case []interface{}:
+		return len(v), nil
+	case map[string]interface{}:
+		return len(v), nil
+	case string:
+		return len(v), nil
+	}
+	return 0, errors.New("has no length")
+}
+
+// check returns an error if the decoded JSON fails this assertion.
+func (jac JSONAssertionConfig) check(data interface{}) error {
+	value, exists := jac.ParsedPath.Lookup(data)
+
+	if jac.Exists != nil && !*jac.Exists {
+		if exists {
+			return fmt.Errorf("JSON %s exists but should not", jac.Path)
+		}
+		return nil
+	}
+	if !exists {
+		return fmt.Errorf("JSON %s does not exist", jac.Path)
+	}
+
+	if jac.Equals != nil {
+		normalised, _ := normaliseJSONScalar(value)
+		if normalised != jac.Equals {
+			return fmt.Errorf("JSON %s is [%v], expected [%v]", jac.Path, value, jac.Equals)
+		}
+	}
+
+	if jac.LessThan != nil || jac.GreaterThan != nil {
+		number, isNumber := value.(float64)
+		if !isNumber {
+			return fmt.Errorf("JSON %s is [%v], which is not a number", jac.Path, value)
+		}
+		if jac.LessThan != nil && !(number < *jac.LessThan) {
+			return fmt.Errorf("JSON %s is %v, expected less than %v", jac.Path, number, *jac.LessThan)
+		}
+		if jac.GreaterThan != nil && !(number > *jac.GreaterThan) {
+			return fmt.Errorf("JSON %s is %v, expected greater than %v", jac.Path, number, *jac.GreaterThan)
+		}
+	}
+
+	if jac.Length != nil || jac.MinLength != nil || jac.MaxLength != nil {
+		length, err := jsonLength(value)
+		if err != nil {
+			return fmt.Errorf("JSON %s %s", jac.Path, err.Error())
+		}
+		if jac.Length != nil && length != *jac.Length {
+			return fmt.Errorf("JSON %s has length %d, expected %d", jac.Path, length, *jac.Length)
+		}
+		if jac.MinLength != nil && length < *jac.MinLength {
+			return fmt.Errorf("JSON %s has length %d, expected at least %d", jac.Path, length, *jac.MinLength)
+		}
+		if jac.MaxLength != nil && length > *jac.MaxLength {
+			return fmt.Errorf("JSON %s has length %d, expected at most %d", jac.Path, length, *jac.MaxLength)
+		}
+	}
+
+	return nil
+}
+
+// checkJSON decodes the given body and checks it against the given assertions.
+func checkJSON(body []byte, assertions []JSONAssertionConfig) error {
+	var data interface{}
+	err := json.Unmarshal(body, &data)
+	if err != nil {
+		return fmt.Errorf("Could not parse JSON response: %s", err.Error())
+	}
+
+	for _, assertion := range assertions {
+		err = assertion.check(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CheckJSONAPI checks the given JSON API endpoint and returns an error if it doesn't work.
+func CheckJSONAPI(ctx context.Context, name string, config JSONAPIConfig) error {
+	log.Println("Checking JSON API", name, "-", config.URL)
+
+	return withUserAgents(config.WebpageConfig, func(userAgent string, useUserAgent bool) error {
+		body, err := fetchPage(ctx, config.WebpageConfig, userAgent, useUserAgent)
+		if err != nil {
+			return err
+		}
+		return checkJSON(body, config.JSON)
+	})
+}
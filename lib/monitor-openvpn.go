@@ -0,0 +1,148 @@
+package lib
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/LondonTrustMedia/downtime_alert/lib/slo"
+)
+
+// parse loads our keys and certificates.
+func (config *OpenVPNConfig) parse() error {
+	if config.Host == "" {
+		return errors.New("No host given")
+	}
+	if config.Port == 0 {
+		config.Port = 1194
+	}
+
+	config.Protocol = strings.ToLower(config.Protocol)
+	if config.Protocol == "" {
+		config.Protocol = "udp"
+	}
+	if config.Protocol != "udp" && config.Protocol != "tcp" {
+		return fmt.Errorf("Protocol %s is not supported, must be udp or tcp", config.Protocol)
+	}
+
+	if config.TLSAuth != "" && config.TLSCrypt != "" {
+		return errors.New("Only one of tls-auth and tls-crypt can be used")
+	}
+	if config.TLSAuth != "" {
+		if config.Auth == "" {
+			config.Auth = "SHA1"
+		}
+		if _, exists := openVPNHMACDigests[strings.ToUpper(config.Auth)]; !exists {
+			return fmt.Errorf("auth digest %s is not supported", config.Auth)
+		}
+		if config.KeyDirection != nil && *config.KeyDirection != 0 && *config.KeyDirection != 1 {
+			return errors.New("key-direction must be 0 or 1")
+		}
+
+		data, err := ioutil.ReadFile(config.TLSAuth)
+		if err != nil {
+			return err
+		}
+		config.TLSAuthKey, err = ParseOpenVPNStaticKey(data)
+		if err != nil {
+			return fmt.Errorf("Could not load tls-auth key: %s", err.Error())
+		}
+	}
+	if config.TLSCrypt != "" {
+		data, err := ioutil.ReadFile(config.TLSCrypt)
+		if err != nil {
+			return err
+		}
+		config.TLSCryptKey, err = ParseOpenVPNStaticKey(data)
+		if err != nil {
+			return fmt.Errorf("Could not load tls-crypt key: %s", err.Error())
+		}
+	}
+
+	// OpenVPN server certificates don't usually match the server's hostname, so we only verify the chain
+	config.ClientTLSConfig = &tls.Config{
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if config.CA != "" {
+		data, err := ioutil.ReadFile(config.CA)
+		if err != nil {
+			return err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(data) {
+			return errors.New("Could not load any certificates from ca")
+		}
+		config.ClientTLSConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyCertificateChain(rawCerts, roots)
+		}
+	}
+	if config.Cert != "" || config.Key != "" {
+		cert, err := tls.LoadX509KeyPair(config.Cert, config.Key)
+		if err != nil {
+			return fmt.Errorf("Could not load client certificate: %s", err.Error())
+		}
+		config.ClientTLSConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return nil
+}
+
+// verifyCertificateChain verifies the given chain against our roots, without checking the hostname.
+func verifyCertificateChain(rawCerts [][]byte, roots *x509.CertPool) error {
+	var certs []*x509.Certificate
+	for _, rawCert := range rawCerts {
+		cert, err := x509.ParseCertificate(rawCert)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) < 1 {
+		return errors.New("Server sent no certificates")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
+
+// CheckOpenVPN performs an OpenVPN handshake with the given gateway and tracks results in the tracker.
+func CheckOpenVPN(ctx context.Context, tracker *slo.PingTracker, config OpenVPNConfig, credsToUse int) error {
+	log.Println("Checking OpenVPN gateway", config.Host, "over", strings.ToUpper(config.Protocol))
+
+	var creds *UserPassCredentialConfig
+	if len(config.Credentials) > 0 {
+		creds = &config.Credentials[credsToUse]
+	}
+
+	handshakeTime, err := openVPNHandshake(ctx, config, creds)
+	if IsTimeout(err) {
+		tracker.AddTimeout(time.Now(), err.Error())
+		return err
+	} else if IsAuthFailure(err) {
+		tracker.AddAuthFailure(time.Now(), err.Error())
+		return err
+	} else if err != nil {
+		tracker.AddFailure(time.Now(), err.Error())
+		return err
+	}
+
+	tracker.AddPing(time.Now(), handshakeTime)
+	log.Println("OpenVPN", config.Host, "- Handshake completed in", handshakeTime)
+
+	return nil
+}
@@ -1,6 +1,7 @@
 package lib
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"time"
@@ -10,7 +11,7 @@ import (
 )
 
 // CheckPing checks the given host and tracks results in the tracker.
-func CheckPing(tracker *slo.PingTracker, config PingConfig) error {
+func CheckPing(ctx context.Context, tracker *slo.PingTracker, config PingConfig) error {
 	log.Println("Checking PING on", config.Host)
 
 	// test ping connectivity
@@ -20,15 +21,42 @@ func CheckPing(tracker *slo.PingTracker, config PingConfig) error {
 	}
 
 	pinger.Count = config.PingsPerRun
+	if deadline, hasDeadline := ctx.Deadline(); hasDeadline {
+		pinger.Timeout = time.Until(deadline)
+	}
+
+	// stop pinging if we're cancelled
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			pinger.Stop()
+		case <-finished:
+		}
+	}()
 
-	pinger.Run()                 // blocks until finished
+	pinger.Run() // blocks until finished
+	close(finished)
 	stats := pinger.Statistics() // get send/receive/rtt stats
 
+	// if we ran out of time, unanswered pings are timeouts rather than plain failures
+	timedOut := ctx.Err() == context.DeadlineExceeded || (pinger.Timeout > 0 && stats.PacketsSent < config.PingsPerRun)
+
 	for _, rtt := range stats.Rtts {
 		tracker.AddPing(time.Now(), rtt)
 	}
 	for i := 1; i <= stats.PacketsSent-stats.PacketsRecv; i++ {
-		tracker.AddFailure(time.Now())
+		if timedOut {
+			tracker.AddTimeout(time.Now(), "Timed out waiting for reply")
+		} else {
+			tracker.AddFailure(time.Now(), "No reply")
+		}
+	}
+	if timedOut {
+		// pings we didn't get to send also count against us
+		for i := stats.PacketsSent; i < config.PingsPerRun; i++ {
+			tracker.AddTimeout(time.Now(), "Timed out before sending")
+		}
 	}
 
 	log.Println("Pinged", config.Host, "-", stats.PacketsSent, "sent,", stats.PacketsRecv, "received, lost", fmt.Sprintf("%.2f%%", stats.PacketLoss*100))
@@ -1,91 +1,120 @@
 package lib
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"math/rand"
 	"net"
-	"net/url"
-	"strconv"
-	"time"
-
 	"net/http"
-
+	"strconv"
 	"strings"
+	"time"
 
 	"code.cloudfoundry.org/bytefmt"
-	"github.com/DanielOaks/proxyclient"
 	"github.com/LondonTrustMedia/downtime_alert/lib/slo"
 )
 
-// CheckSocks5 checks the given SOCKS5 proxy and returns an error if it doesn't work.
-func CheckSocks5(tracker *slo.DownloadTracker, config Socks5Config, credsToUse int) error {
-	log.Println("Checking SOCKS5 proxy", config.Host)
+// newSocks5Client returns an HTTP client that connects through the given SOCKS5 proxy, and the dialer
+// it uses. Hostnames are resolved by the proxy, and HTTPS targets work too.
+func newSocks5Client(config Socks5Config, credsToUse int) (*http.Client, *socks5Dialer) {
+	dialer := &socks5Dialer{
+		proxyAddress:     net.JoinHostPort(config.Host, strconv.Itoa(config.Port)),
+		requireRemoteDNS: config.Egress.RemoteDNS,
+		phases:           newPhaseTimings(),
+	}
+	if len(config.Credentials) > 0 {
+		dialer.username = config.Credentials[credsToUse].Username
+		dialer.password = config.Credentials[credsToUse].Password
+	}
 
-	// assemble socks5 url
-	userpass := url.UserPassword(config.Credentials[credsToUse].Username, config.Credentials[credsToUse].Password)
-	socksURL := url.URL{
-		Scheme: "socks5",
-		User:   userpass,
-		Host:   net.JoinHostPort(config.Host, strconv.Itoa(config.Port)),
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext:       dialer.DialContext,
+			DisableKeepAlives: true,
+		},
 	}
+	return client, dialer
+}
 
-	// test proxy and connectivity through the proxy
-	p, err := proxyclient.NewProxyClient(socksURL.String())
+// checkEgress confirms that traffic through the proxy exits from one of our allowed networks.
+func checkEgress(ctx context.Context, config Socks5Config, credsToUse int) error {
+	client, dialer := newSocks5Client(config, credsToUse)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", replaceVariables(config.Egress.URL, nil), nil)
 	if err != nil {
-		return err
+		return fmt.Errorf("Could not create request: %s", err.Error())
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return classifyRequestError(ctx, err)
 	}
+	defer resp.Body.Close()
 
-	urlString := config.TestDownload.URL
-	if strings.Contains(urlString, "{{random-int}}") {
-		urlString = strings.Replace(urlString, "{{random-int}}", strconv.Itoa(rand.Int()), -1)
+	if resp.StatusCode < 200 || 299 < resp.StatusCode {
+		return fmt.Errorf("Egress url returned status %s", resp.Status)
 	}
-	req, err := http.NewRequest("GET", urlString, nil)
+	body, err := readResponseBody(resp.Body, 64*1024)
 	if err != nil {
-		return err
+		return checkTimeout(ctx, err)
 	}
-	if config.TestDownload.MaxBytesToDL > 0 {
-		req.Header.Add("Range", fmt.Sprintf("bytes=0-%d", config.TestDownload.MaxBytesToDL))
+
+	if config.Egress.RemoteDNS && !dialer.remoteDNS {
+		return &EgressError{Err: errors.New("Hostname was not resolved by the proxy")}
 	}
 
-	u, err := url.Parse(config.TestDownload.URL)
-	if err != nil {
-		return err
+	address := strings.TrimSpace(string(body))
+	if config.Egress.ParsedJSONPath != nil {
+		var data interface{}
+		err = json.Unmarshal(body, &data)
+		if err != nil {
+			return fmt.Errorf("Could not parse egress url's JSON response: %s", err.Error())
+		}
+		value, exists := config.Egress.ParsedJSONPath.Lookup(data)
+		address, _ = value.(string)
+		if !exists || address == "" {
+			return fmt.Errorf("Egress url's response has no address at %s", config.Egress.JSONPath)
+		}
 	}
 
-	var host string
-	if strings.Contains(u.Host, ":") {
-		// bleh
-		host = u.Host
-	} else {
-		host = net.JoinHostPort(u.Host, "80")
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return fmt.Errorf("Egress url returned an invalid address [%s]", address)
+	}
+	for _, network := range config.Egress.AllowedNetworks {
+		if network.Contains(ip) {
+			log.Println("SOCKS5", config.Host, "- Traffic exits from", ip)
+			return nil
+		}
 	}
 
-	conn, err := p.Dial("tcp", host)
-	if err != nil {
-		return err
+	return &EgressError{Err: fmt.Errorf("Traffic exits from %s, which isn't in allowed-cidrs [%s]", ip, strings.Join(config.Egress.AllowedCIDRs, ", "))}
+}
+
+// CheckSocks5 checks the given SOCKS5 proxy and returns an error if it doesn't work.
+func CheckSocks5(ctx context.Context, tracker *slo.DownloadTracker, config Socks5Config, credsToUse int) error {
+	log.Println("Checking SOCKS5 proxy", config.Host)
+
+	if config.Egress.URL != "" {
+		err := checkEgress(ctx, config, credsToUse)
+		if err != nil {
+			return err
+		}
 	}
 
-	// write our actual HTTP request
-	req.Write(conn)
+	client, dialer := newSocks5Client(config, credsToUse)
 
-	// download
 	downloadStartedTime := time.Now()
-	defer conn.Close()
-	body, err := ioutil.ReadAll(conn)
+	downloadSizeBytes, downloadSpeedBytesPerSecond, err := testDownload(ctx, client, config.TestDownload, dialer.phases)
 	if err != nil {
 		return err
 	}
-	downloadEndedTime := time.Now()
-
-	downloadElapsedSeconds := downloadEndedTime.Unix() - downloadStartedTime.Unix()
-	downloadSizeBytes := uint64(len(body))
-	downloadSpeedBytesPerSecond := downloadSizeBytes / uint64(downloadElapsedSeconds)
 
-	log.Println("SOCKS5", config.Host, "- Downloaded", bytefmt.ByteSize(downloadSizeBytes), "in", downloadElapsedSeconds, "seconds --", fmt.Sprintf("%s/s", bytefmt.ByteSize(downloadSpeedBytesPerSecond)))
+	phases := dialer.phases.Phases()
+	log.Println("SOCKS5", config.Host, "- Downloaded", bytefmt.ByteSize(downloadSizeBytes), "in", phases[slo.PhaseTransfer], "--", fmt.Sprintf("%s/s", bytefmt.ByteSize(downloadSpeedBytesPerSecond)))
 
-	tracker.AddDownload(downloadStartedTime, downloadSpeedBytesPerSecond)
+	tracker.AddDownload(downloadStartedTime, downloadSpeedBytesPerSecond, phases)
 
 	// no errors!
 	return nil
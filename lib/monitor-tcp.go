@@ -0,0 +1,99 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/LondonTrustMedia/downtime_alert/lib/slo"
+)
+
+// maxBannerBytes is the most we'll read while waiting for a banner to match.
+const maxBannerBytes = 4096
+
+// readBanner reads from the connection until the banner matches our regex, the connection is
+// closed or we hit the deadline.
+func readBanner(conn net.Conn, config TCPConfig) error {
+	conn.SetReadDeadline(time.Now().Add(config.BannerTimeoutDuration))
+
+	banner := make([]byte, 0, maxBannerBytes)
+	buf := make([]byte, 512)
+	for len(banner) < maxBannerBytes {
+		n, err := conn.Read(buf)
+		banner = append(banner, buf[:n]...)
+		if config.ParsedBannerRegex.Match(banner) {
+			return nil
+		}
+		if err != nil {
+			if len(banner) < 1 {
+				return fmt.Errorf("No banner received: %w", err)
+			}
+			break
+		}
+	}
+
+	return fmt.Errorf("Banner did not match regex [%s]\nBanner: %q", config.BannerRegex, banner)
+}
+
+// CheckTCP connects to the given port, sends our payload and checks the banner, tracking results in
+// the tracker. Connect time is recorded when the whole check succeeds.
+func CheckTCP(ctx context.Context, tracker *slo.PingTracker, config TCPConfig) error {
+	log.Println("Checking TCP port", config.Host, config.Port)
+
+	var dialer net.Dialer
+	connectStartedTime := time.Now()
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(config.Host, strconv.Itoa(config.Port)))
+	if err != nil {
+		err = classifyRequestError(ctx, err)
+		if IsTimeout(err) {
+			tracker.AddTimeout(time.Now(), err.Error())
+		} else {
+			tracker.AddFailure(time.Now(), err.Error())
+		}
+		return err
+	}
+	connectTime := time.Since(connectStartedTime)
+	defer conn.Close()
+	defer closeOnDone(ctx, conn)()
+
+	if config.Payload != "" {
+		if deadline, hasDeadline := ctx.Deadline(); hasDeadline {
+			conn.SetWriteDeadline(deadline)
+		}
+		_, err = conn.Write([]byte(config.Payload))
+		if err != nil {
+			err = checkTimeout(ctx, err)
+			if IsTimeout(err) {
+				tracker.AddTimeout(time.Now(), err.Error())
+				return err
+			}
+			err = fmt.Errorf("Could not send payload: %s", err.Error())
+			tracker.AddFailure(time.Now(), err.Error())
+			return err
+		}
+	}
+
+	if config.ParsedBannerRegex != nil {
+		err = readBanner(conn, config)
+		if err != nil && ctx.Err() != nil {
+			err = &TimeoutError{Err: errors.New("Timed out reading banner")}
+		}
+		err = checkTimeout(ctx, err)
+		if IsTimeout(err) {
+			tracker.AddTimeout(time.Now(), err.Error())
+			return err
+		} else if err != nil {
+			tracker.AddFailure(time.Now(), err.Error())
+			return err
+		}
+	}
+
+	tracker.AddPing(time.Now(), connectTime)
+	log.Println("Connected to", config.Host, config.Port, "in", connectTime)
+
+	return nil
+}
@@ -0,0 +1,112 @@
+package lib
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TLSCertificateInfo describes the certificate presented by a TLS server.
+type TLSCertificateInfo struct {
+	Subject  string
+	Issuer   string
+	NotAfter time.Time
+}
+
+// TimeUntilExpiry returns how long is left until the certificate expires.
+func (info TLSCertificateInfo) TimeUntilExpiry() time.Duration {
+	return time.Until(info.NotAfter)
+}
+
+// DaysUntilExpiry returns how many whole days are left until the certificate expires.
+func (info TLSCertificateInfo) DaysUntilExpiry() int {
+	return int(info.TimeUntilExpiry() / (24 * time.Hour))
+}
+
+// CheckTLS connects to the given host, validates its certificate chain and hostname and returns
+// details of its certificate. If we received a certificate, it's returned even if it isn't valid.
+func CheckTLS(ctx context.Context, name string, config TLSConfig) (*TLSCertificateInfo, error) {
+	log.Println("Checking TLS certificate", name, "-", config.ServerName)
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(config.Host, strconv.Itoa(config.Port)))
+	if err != nil {
+		return nil, classifyRequestError(ctx, err)
+	}
+	defer conn.Close()
+	if deadline, hasDeadline := ctx.Deadline(); hasDeadline {
+		conn.SetDeadline(deadline)
+	}
+
+	// we verify the chain ourselves below, so we can still report on invalid certificates
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName:         config.ServerName,
+		InsecureSkipVerify: true,
+	})
+	err = tlsConn.Handshake()
+	if err != nil {
+		err = checkTimeout(ctx, err)
+		if IsTimeout(err) {
+			return nil, err
+		}
+		return nil, &RequestError{Category: RequestErrorTLS, Err: err}
+	}
+
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) < 1 {
+		return nil, &RequestError{Category: RequestErrorTLS, Err: errors.New("Server sent no certificates")}
+	}
+
+	leaf := certs[0]
+	info := &TLSCertificateInfo{
+		Subject:  leaf.Subject.CommonName,
+		Issuer:   leaf.Issuer.CommonName,
+		NotAfter: leaf.NotAfter,
+	}
+	if info.Subject == "" && len(leaf.DNSNames) > 0 {
+		info.Subject = leaf.DNSNames[0]
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err = leaf.Verify(x509.VerifyOptions{
+		DNSName:       config.ServerName,
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		return info, fmt.Errorf("Certificate is not valid: %s", err.Error())
+	}
+
+	return info, nil
+}
+
+// FormatTLSCertificateInfo returns a description of the certificate for alerts.
+func FormatTLSCertificateInfo(info *TLSCertificateInfo) string {
+	if info == nil {
+		return "No certificate received"
+	}
+
+	var expiry string
+	if info.TimeUntilExpiry() < 0 {
+		expiry = fmt.Sprintf("Expired %d days ago", -info.DaysUntilExpiry())
+	} else {
+		expiry = fmt.Sprintf("Expires in %d days", info.DaysUntilExpiry())
+	}
+
+	return strings.Join([]string{
+		fmt.Sprintf("Subject: %s", info.Subject),
+		fmt.Sprintf("Issuer: %s", info.Issuer),
+		fmt.Sprintf("Not After: %s", info.NotAfter.Format(time.RFC1123)),
+		expiry,
+	}, "\n")
+}
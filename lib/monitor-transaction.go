@@ -0,0 +1,202 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/cookiejar"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ExtractConfig extracts a variable from a step's response, for use in later steps as {{variable}}.
+type ExtractConfig struct {
+	Variable       string
+	Regex          string
+	ParsedRegex    *regexp.Regexp
+	JSONPath       string `yaml:"json-path"`
+	ParsedJSONPath *JSONPath
+	Header         string
+}
+
+// parse parses our regex or JSONPath and confirms that exactly one extraction method is set.
+func (ec *ExtractConfig) parse() error {
+	if ec.Variable == "" {
+		return errors.New("Extract has no variable name")
+	}
+
+	var methods int
+	for _, method := range []string{ec.Regex, ec.JSONPath, ec.Header} {
+		if method != "" {
+			methods++
+		}
+	}
+	if methods != 1 {
+		return fmt.Errorf("Extract %s must have exactly one of regex, json-path or header", ec.Variable)
+	}
+
+	var err error
+	if ec.Regex != "" {
+		ec.ParsedRegex, err = regexp.Compile(ec.Regex)
+		if err != nil {
+			return fmt.Errorf("Could not parse regex for %s [%s]: %s", ec.Variable, ec.Regex, err.Error())
+		}
+	}
+	if ec.JSONPath != "" {
+		ec.ParsedJSONPath, err = ParseJSONPath(ec.JSONPath)
+		if err != nil {
+			return fmt.Errorf("Could not parse json-path for %s: %s", ec.Variable, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// extract returns the value of our variable from the given response.
+func (ec ExtractConfig) extract(resp *http.Response, body []byte) (string, error) {
+	if ec.Header != "" {
+		value := resp.Header.Get(ec.Header)
+		if value == "" {
+			return "", fmt.Errorf("Could not extract %s: header %s was missing", ec.Variable, ec.Header)
+		}
+		return value, nil
+	}
+
+	if ec.ParsedRegex != nil {
+		matches := ec.ParsedRegex.FindSubmatch(body)
+		if matches == nil {
+			return "", fmt.Errorf("Could not extract %s: body did not match regex [%s]", ec.Variable, ec.Regex)
+		}
+		// use the first capture group if there is one
+		if len(matches) > 1 {
+			return string(matches[1]), nil
+		}
+		return string(matches[0]), nil
+	}
+
+	var data interface{}
+	err := json.Unmarshal(body, &data)
+	if err != nil {
+		return "", fmt.Errorf("Could not extract %s: could not parse JSON response: %s", ec.Variable, err.Error())
+	}
+	value, exists := ec.ParsedJSONPath.Lookup(data)
+	if !exists {
+		return "", fmt.Errorf("Could not extract %s: JSON %s does not exist", ec.Variable, ec.JSONPath)
+	}
+	if str, isString := value.(string); isString {
+		return str, nil
+	}
+	// numbers, objects, etc are used as their JSON representation
+	valueBytes, _ := json.Marshal(value)
+	return string(valueBytes), nil
+}
+
+// parse parses all the config in this step.
+func (step *TransactionStepConfig) parse() error {
+	if step.URL == "" {
+		return errors.New("Step has no url")
+	}
+
+	err := step.HTTPAssertionsConfig.parse()
+	if err != nil {
+		return err
+	}
+
+	for i := range step.JSON {
+		err = step.JSON[i].parse()
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := range step.Extract {
+		err = step.Extract[i].parse()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// replaceVariables replaces {{name}} with the value of each variable, and {{random-int}} with a random integer.
+func replaceVariables(input string, variables map[string]string) string {
+	if !strings.Contains(input, "{{") {
+		return input
+	}
+	for name, value := range variables {
+		input = strings.Replace(input, fmt.Sprintf("{{%s}}", name), value, -1)
+	}
+	if strings.Contains(input, "{{random-int}}") {
+		input = strings.Replace(input, "{{random-int}}", strconv.Itoa(rand.Int()), -1)
+	}
+	return input
+}
+
+// runStep runs a single transaction step, adding any extracted variables to variables.
+func runStep(ctx context.Context, client *http.Client, step TransactionStepConfig, userAgent string, variables map[string]string) error {
+	request := HTTPRequestConfig{
+		Method:         step.Method,
+		RequestHeaders: make(map[string]string),
+		Body:           replaceVariables(step.Body, variables),
+	}
+	for name, value := range step.RequestHeaders {
+		request.RequestHeaders[name] = replaceVariables(value, variables)
+	}
+
+	resp, body, err := doHTTPCheck(ctx, client, replaceVariables(step.URL, variables), request, step.HTTPAssertionsConfig, userAgent)
+	if err != nil {
+		return err
+	}
+
+	if len(step.JSON) > 0 {
+		err = checkJSON(body, step.JSON)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, extract := range step.Extract {
+		value, err := extract.extract(resp, body)
+		if err != nil {
+			return err
+		}
+		variables[extract.Variable] = value
+	}
+
+	return nil
+}
+
+// CheckTransaction runs the given transaction's steps in order and returns an error naming the step that failed.
+func CheckTransaction(ctx context.Context, name string, config TransactionConfig) error {
+	log.Println("Checking transaction", name)
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{
+		Jar: jar,
+	}
+
+	variables := make(map[string]string)
+
+	for i, step := range config.Steps {
+		stepName := step.Name
+		if stepName == "" {
+			stepName = step.URL
+		}
+
+		err = runStep(ctx, client, step, config.UserAgent, variables)
+		if err != nil {
+			return fmt.Errorf("Failed at step %d of %d\nStep: %s\nError: %s", i+1, len(config.Steps), stepName, err.Error())
+		}
+	}
+
+	return nil
+}
@@ -1,72 +1,85 @@
 package lib
 
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
-	"strings"
+	"time"
 )
 
-func checkPage(name string, config WebpageConfig, userAgent string, useUserAgent bool) error {
-	client := &http.Client{}
-
-	req, err := http.NewRequest("GET", config.URL, nil)
+// doHTTPCheck makes the given request with the given client, checks the response against our
+// assertions and returns the response and its body. If userAgent is empty, the default is used.
+func doHTTPCheck(ctx context.Context, client *http.Client, url string, request HTTPRequestConfig, assertions HTTPAssertionsConfig, userAgent string) (*http.Response, []byte, error) {
+	req, err := request.newRequest(ctx, url)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, nil, fmt.Errorf("Could not create request: %s", err.Error())
 	}
 
-	if config.UserAgent != "" {
-		req.Header.Set("User-Agent", config.UserAgent)
+	if userAgent != "" {
+		req.Header.Set("User-Agent", userAgent)
 	}
 
+	requestStartedTime := time.Now()
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, nil, classifyRequestError(ctx, err)
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("Status: %s", resp.Status)
-	}
 	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+	err = assertions.checkStatusCode(resp)
+	if err != nil {
+		return resp, nil, err
+	}
+	body, err := readResponseBody(resp.Body, assertions.MaxBodyBytes)
 	if err != nil {
-		return fmt.Errorf("Could not read response body: %s", err.Error())
+		return resp, nil, checkTimeout(ctx, err)
 	}
 
-	// if we have the mode enabled to extract strings
-	if len(config.Matches) > 0 {
-		bodyString := string(body)
+	return resp, body, assertions.checkResponse(resp, body, time.Since(requestStartedTime))
+}
 
-		for _, m := range config.Matches {
-			if !strings.Contains(bodyString, m) {
-				return fmt.Errorf("Body did not contain required string [%s]", m)
-			}
-		}
+// fetchPage requests the given page, checks the response against our assertions and returns the body.
+func fetchPage(ctx context.Context, config WebpageConfig, userAgent string, useUserAgent bool) ([]byte, error) {
+	if !useUserAgent {
+		userAgent = ""
 	}
+	_, body, err := doHTTPCheck(ctx, &http.Client{}, config.URL, config.HTTPRequestConfig, config.HTTPAssertionsConfig, userAgent)
+	return body, err
+}
 
-	return nil
+func checkPage(ctx context.Context, name string, config WebpageConfig, userAgent string, useUserAgent bool) error {
+	_, err := fetchPage(ctx, config, userAgent, useUserAgent)
+	return err
 }
 
 // CheckWebpage checks the given web page and returns an error if it doesn't work.
-func CheckWebpage(name string, config WebpageConfig) error {
+func CheckWebpage(ctx context.Context, name string, config WebpageConfig) error {
 	log.Println("Checking web page", name, "-", config.URL)
 
+	return withUserAgents(config, func(userAgent string, useUserAgent bool) error {
+		return checkPage(ctx, name, config, userAgent, useUserAgent)
+	})
+}
+
+// withUserAgents runs check once with each of the page's user agents, or once with its single user
+// agent (if set) otherwise, stopping at the first failure.
+func withUserAgents(config WebpageConfig, check func(userAgent string, useUserAgent bool) error) error {
 	var err error
 
 	if len(config.UserAgents) > 0 {
 		for _, agent := range config.UserAgents {
 			log.Println("Using user agent", agent)
-			err = checkPage(name, config, agent, true)
+			err = check(agent, true)
 			if err != nil {
-				err = fmt.Errorf("Failed\nUser Agent: %s\nError: %s", agent, err.Error())
+				err = fmt.Errorf("Failed\nUser Agent: %s\nError: %w", agent, err)
 				break
 			}
 		}
 	} else if config.UserAgent != "" {
-		err = checkPage(name, config, config.UserAgent, true)
+		err = check(config.UserAgent, true)
 	} else {
-		err = checkPage(name, config, "", false)
+		err = check("", false)
 	}
 
 	return err
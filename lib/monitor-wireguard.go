@@ -0,0 +1,166 @@
+package lib
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/LondonTrustMedia/downtime_alert/lib/slo"
+	"golang.org/x/crypto/curve25519"
+)
+
+// wireGuardRetryInterval is how long we wait for a handshake response before trying again, the same
+// as WireGuard's REKEY_TIMEOUT.
+const wireGuardRetryInterval = 5 * time.Second
+
+// parseWireGuardKey parses a base64 key, as used in WireGuard config files.
+func parseWireGuardKey(name, key string) ([]byte, error) {
+	if key == "" {
+		return nil, fmt.Errorf("No %s given", name)
+	}
+	keyBytes, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(keyBytes) != 32 {
+		return nil, fmt.Errorf("%s must be a base64 encoded 32 byte key", name)
+	}
+	return keyBytes, nil
+}
+
+// parse parses our keys.
+func (config *WireGuardConfig) parse() error {
+	if config.Endpoint == "" {
+		return errors.New("No endpoint given")
+	}
+	_, _, err := net.SplitHostPort(config.Endpoint)
+	if err != nil {
+		return fmt.Errorf("endpoint must be host:port: %s", err.Error())
+	}
+
+	config.ServerPublicKey, err = parseWireGuardKey("public-key", config.PublicKey)
+	if err != nil {
+		return err
+	}
+	config.ClientPrivateKey, err = parseWireGuardKey("private-key", config.PrivateKey)
+	if err != nil {
+		return err
+	}
+	config.ClientPublicKey, err = curve25519.X25519(config.ClientPrivateKey, curve25519.Basepoint)
+	if err != nil {
+		return err
+	}
+
+	if config.PresharedKey != "" {
+		config.PresharedKeyBytes, err = parseWireGuardKey("preshared-key", config.PresharedKey)
+		if err != nil {
+			return err
+		}
+	} else {
+		config.PresharedKeyBytes = make([]byte, 32)
+	}
+
+	return nil
+}
+
+// exchange sends the given initiation and waits for the server's response, retrying with a cookie
+// once if the server is under load. It returns false if the server doesn't respond in time.
+func (hs *wireGuardHandshake) exchange(ctx context.Context, conn net.Conn, initiation []byte) (time.Duration, bool, error) {
+	buf := make([]byte, 256)
+	deadline, hasDeadline := ctx.Deadline()
+	var usedCookie bool
+
+	for {
+		handshakeStartedTime := time.Now()
+		_, err := conn.Write(initiation)
+		if err != nil {
+			return 0, false, checkTimeout(ctx, err)
+		}
+
+		readDeadline := handshakeStartedTime.Add(wireGuardRetryInterval)
+		if hasDeadline && deadline.Before(readDeadline) {
+			readDeadline = deadline
+		}
+		conn.SetReadDeadline(readDeadline)
+
+		var gotCookie bool
+		for !gotCookie {
+			n, err := conn.Read(buf)
+			if netErr, isNetErr := err.(net.Error); isNetErr && netErr.Timeout() && ctx.Err() == nil && (!hasDeadline || time.Now().Before(deadline)) {
+				return 0, false, nil
+			} else if err != nil {
+				return 0, false, checkTimeout(ctx, err)
+			}
+			rtt := time.Since(handshakeStartedTime)
+
+			message := buf[:n]
+			if len(message) < 4 {
+				continue
+			}
+			switch message[0] {
+			case wireGuardHandshakeResponse:
+				return rtt, true, hs.checkResponse(message)
+			case wireGuardCookieReply:
+				if usedCookie {
+					return 0, false, errors.New("Server is under load and rejected our handshake")
+				}
+				err = hs.addCookie(initiation, message)
+				if err != nil {
+					return 0, false, err
+				}
+				usedCookie = true
+				gotCookie = true
+			}
+		}
+	}
+}
+
+// wireGuardHandshakeRTT starts new handshakes until the server responds, and returns how long the
+// successful handshake took.
+func wireGuardHandshakeRTT(ctx context.Context, conn net.Conn, config WireGuardConfig) (time.Duration, error) {
+	for {
+		hs, initiation, err := newWireGuardInitiation(config)
+		if err != nil {
+			return 0, err
+		}
+
+		rtt, responded, err := hs.exchange(ctx, conn, initiation)
+		if err != nil {
+			return 0, err
+		}
+		if responded {
+			return rtt, nil
+		}
+	}
+}
+
+// CheckWireGuard performs a WireGuard handshake with the given endpoint and tracks results in the tracker.
+func CheckWireGuard(ctx context.Context, tracker *slo.PingTracker, config WireGuardConfig) error {
+	log.Println("Checking WireGuard endpoint", config.Endpoint)
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", config.Endpoint)
+	if err != nil {
+		err = classifyRequestError(ctx, err)
+		tracker.AddFailure(time.Now(), err.Error())
+		return err
+	}
+	defer conn.Close()
+	defer closeOnDone(ctx, conn)()
+
+	rtt, err := wireGuardHandshakeRTT(ctx, conn, config)
+	if IsTimeout(err) {
+		err = fmt.Errorf("No handshake response: %w", err)
+		tracker.AddTimeout(time.Now(), err.Error())
+		return err
+	} else if err != nil {
+		tracker.AddFailure(time.Now(), err.Error())
+		return err
+	}
+
+	tracker.AddPing(time.Now(), rtt)
+	log.Println("WireGuard", config.Endpoint, "- Handshake completed in", rtt)
+
+	return nil
+}
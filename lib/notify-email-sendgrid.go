@@ -1,10 +1,105 @@
 package lib
 
 import (
+	"errors"
+	"fmt"
+
 	sendgrid "github.com/sendgrid/sendgrid-go"
 	"github.com/sendgrid/sendgrid-go/helpers/mail"
 )
 
+func init() {
+	RegisterNotifier(emailSendgridNotifier{})
+}
+
+// emailSendgridNotifier sends notifications as emails through SendGrid.
+type emailSendgridNotifier struct{}
+
+// Name returns the name of this notifier's config section.
+func (emailSendgridNotifier) Name() string {
+	return "email-sendgrid"
+}
+
+// EmailSendgridConfig holds the configuration for Sendgrid email notifications.
+type EmailSendgridConfig struct {
+	FromName    string `yaml:"from-name"`
+	FromAddress string `yaml:"from-address"`
+	APIKey      string `yaml:"api-key"`
+}
+
+// SendgridAddressConfig holds the config for a Sendgrid email address
+type SendgridAddressConfig struct {
+	Name    string
+	Address string
+}
+
+// ValidateConfig confirms that our targets are addresses, and that we have an API key and from address
+// if any emails are being sent.
+func (n emailSendgridNotifier) ValidateConfig(config NotifyConfig, targets NotifyTargetsConfig) error {
+	var addresses []SendgridAddressConfig
+	err := targets.Decode(n.Name(), &addresses)
+	if err != nil {
+		return fmt.Errorf("Could not parse email targets: %s", err.Error())
+	}
+
+	var settings EmailSendgridConfig
+	err = config.Decode(n.Name(), &settings)
+	if err != nil {
+		return fmt.Errorf("Could not parse settings: %s", err.Error())
+	}
+
+	if len(addresses) < 1 {
+		return nil
+	}
+	if settings.APIKey == "" {
+		return errors.New("api-key must be set to send email notifications")
+	}
+	if settings.FromAddress == "" {
+		return errors.New("from-address must be set to send email notifications")
+	}
+	for _, info := range addresses {
+		if info.Address == "" {
+			return fmt.Errorf("email target [%s] has no address", info.Name)
+		}
+	}
+	return nil
+}
+
+// Send sends a single email to all of the given addresses.
+func (n emailSendgridNotifier) Send(config NotifyConfig, targets NotifyTargetsConfig, message string) []DeliveryResult {
+	// both of these are checked by ValidateConfig
+	var addresses []SendgridAddressConfig
+	targets.Decode(n.Name(), &addresses)
+	var settings EmailSendgridConfig
+	config.Decode(n.Name(), &settings)
+
+	// the same address may be listed under different names by different routes
+	var uniqueAddresses []SendgridAddressConfig
+	seenAddresses := make(map[string]bool)
+	for _, info := range addresses {
+		if !seenAddresses[info.Address] {
+			seenAddresses[info.Address] = true
+			uniqueAddresses = append(uniqueAddresses, info)
+		}
+	}
+	if len(uniqueAddresses) < 1 {
+		return nil
+	}
+
+	// all addresses are sent the same email, so they all succeed or fail together
+	err := SendEmailSendgrid(settings.APIKey, settings.FromName, settings.FromAddress, uniqueAddresses, message)
+
+	var results []DeliveryResult
+	for _, info := range uniqueAddresses {
+		results = append(results, DeliveryResult{
+			Notifier: n.Name(),
+			Target:   info.Address,
+			Err:      err,
+		})
+	}
+	return results
+}
+
 // SendEmailSendgrid sends an email using SendGrid to the specified addresses.
 func SendEmailSendgrid(apiKey string, fromName string, fromAddress string, targets []SendgridAddressConfig, message string) error {
 	m := mail.NewV3Mail()
@@ -23,7 +118,14 @@ func SendEmailSendgrid(apiKey string, fromName string, fromAddress string, targe
 	request := sendgrid.GetRequest(apiKey, "/v3/mail/send", "https://api.sendgrid.com")
 	request.Method = "POST"
 	request.Body = mail.GetRequestBody(m)
-	_, err := sendgrid.API(request)
+	response, err := sendgrid.API(request)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode < 200 || 299 < response.StatusCode {
+		return fmt.Errorf("SendGrid returned status %d: %s", response.StatusCode, response.Body)
+	}
 
-	return err
+	return nil
 }
@@ -6,9 +6,68 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strings"
 )
 
+func init() {
+	RegisterNotifier(smsTelstraNotifier{})
+}
+
+// smsTelstraNotifier sends notifications over Telstra's SMS network.
+type smsTelstraNotifier struct{}
+
+// Name returns the name of this notifier's config section.
+func (smsTelstraNotifier) Name() string {
+	return "sms-telstra"
+}
+
+// SmsTelstraConfig holds the configuration for Telstra SMS notifications.
+type SmsTelstraConfig struct {
+	Key    string
+	Secret string
+}
+
+// ValidateConfig confirms that our targets are phone numbers, and that we have API credentials if
+// any numbers are being sent to.
+func (n smsTelstraNotifier) ValidateConfig(config NotifyConfig, targets NotifyTargetsConfig) error {
+	var phoneNumbers []string
+	err := targets.Decode(n.Name(), &phoneNumbers)
+	if err != nil {
+		return fmt.Errorf("Could not parse phone numbers: %s", err.Error())
+	}
+
+	var settings SmsTelstraConfig
+	err = config.Decode(n.Name(), &settings)
+	if err != nil {
+		return fmt.Errorf("Could not parse settings: %s", err.Error())
+	}
+
+	if len(phoneNumbers) > 0 && (settings.Key == "" || settings.Secret == "") {
+		return errors.New("key and secret must be set to send SMS notifications")
+	}
+	return nil
+}
+
+// Send sends the message to each of the given phone numbers.
+func (n smsTelstraNotifier) Send(config NotifyConfig, targets NotifyTargetsConfig, message string) []DeliveryResult {
+	// both of these are checked by ValidateConfig
+	var phoneNumbers []string
+	targets.Decode(n.Name(), &phoneNumbers)
+	var settings SmsTelstraConfig
+	config.Decode(n.Name(), &settings)
+
+	var results []DeliveryResult
+	for _, phoneNumber := range phoneNumbers {
+		results = append(results, DeliveryResult{
+			Notifier: n.Name(),
+			Target:   phoneNumber,
+			Err:      SendSMSTelstra(settings.Key, settings.Secret, phoneNumber, message),
+		})
+	}
+	return results
+}
+
 // TelstraAuthResponse is the authentication response JSON structure we get back from the API.
 type TelstraAuthResponse struct {
 	AccessToken string `json:"access_token"`
@@ -31,13 +90,17 @@ func (ttm *TelstraTextMessage) ToJSON() (string, error) {
 // SendSMSTelstra sends a message over Telstra's SMS network to the specified number.
 func SendSMSTelstra(consumerKey string, consumerSecret string, number string, message string) error {
 	// get authorization token
-	req, err := http.NewRequest("GET", fmt.Sprintf("https://api.telstra.com/v1/oauth/token?client_id=%s&client_secret=%s&grant_type=client_credentials&scope=SMS", consumerKey, consumerSecret), nil)
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://api.telstra.com/v1/oauth/token?client_id=%s&client_secret=%s&grant_type=client_credentials&scope=SMS", url.QueryEscape(consumerKey), url.QueryEscape(consumerSecret)), nil)
+	if err != nil {
+		return fmt.Errorf("Creating auth token request failed: %s", err.Error())
+	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	response, err := http.DefaultClient.Do(req)
 
 	if err != nil {
 		return fmt.Errorf("Retrieving auth token failed: %s", err.Error())
 	}
+	defer response.Body.Close()
 
 	// parse out auth token
 	var authResponse TelstraAuthResponse
@@ -67,6 +130,9 @@ func SendSMSTelstra(consumerKey string, consumerSecret string, number string, me
 	}
 
 	req, err = http.NewRequest("POST", "https://api.telstra.com/v1/sms/messages", strings.NewReader(assembledMessageText))
+	if err != nil {
+		return fmt.Errorf("Creating message request failed: %s", err.Error())
+	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", authResponse.AccessToken))
 
@@ -75,6 +141,11 @@ func SendSMSTelstra(consumerKey string, consumerSecret string, number string, me
 	if err != nil {
 		return fmt.Errorf("Failed to send message: %s", err.Error())
 	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || 299 < response.StatusCode {
+		return fmt.Errorf("Failed to send message: %s", response.Status)
+	}
 
 	return nil
 }
@@ -0,0 +1,220 @@
+package lib
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// NotifyModeAdd notifies the given targets as well as the existing ones.
+	NotifyModeAdd = "add"
+	// NotifyModeReplace notifies only the given targets.
+	NotifyModeReplace = "replace"
+	// NotifyModeNone notifies nobody.
+	NotifyModeNone = "none"
+)
+
+// DeliveryResult is the result of sending a notification to a single target.
+type DeliveryResult struct {
+	Notifier string
+	Target   string
+	Err      error
+}
+
+// Notifier is a method of sending notifications, e.g. SMS or email.
+type Notifier interface {
+	// Name returns the name of this notifier's section in the notify config.
+	Name() string
+	// ValidateConfig parses this notifier's sections of the config and targets, and returns an error
+	// if we can't send to the given targets.
+	ValidateConfig(config NotifyConfig, targets NotifyTargetsConfig) error
+	// Send sends the message to this notifier's entries in targets, returning a result for each one.
+	Send(config NotifyConfig, targets NotifyTargetsConfig, message string) []DeliveryResult
+}
+
+var notifiers = make(map[string]Notifier)
+
+// RegisterNotifier adds the given notifier to our registry, keyed by its name.
+func RegisterNotifier(n Notifier) {
+	if _, exists := notifiers[n.Name()]; exists {
+		panic(fmt.Sprintf("Notifier %s registered twice", n.Name()))
+	}
+	notifiers[n.Name()] = n
+}
+
+// GetNotifier returns the notifier registered with the given name.
+func GetNotifier(name string) (Notifier, bool) {
+	n, exists := notifiers[name]
+	return n, exists
+}
+
+// NotifierNames returns the names of all registered notifiers, sorted.
+func NotifierNames() []string {
+	var names []string
+	for name := range notifiers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ValidateNotifiers confirms that every registered notifier can send to the given targets.
+func ValidateNotifiers(config NotifyConfig, targets NotifyTargetsConfig) error {
+	for name := range targets {
+		if _, exists := notifiers[name]; !exists {
+			return fmt.Errorf("Unknown notifier [%s]", name)
+		}
+	}
+	for _, name := range NotifierNames() {
+		err := notifiers[name].ValidateConfig(config, targets)
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err.Error())
+		}
+	}
+	return nil
+}
+
+// SendNotification sends the message to the given targets using every registered notifier.
+func SendNotification(config NotifyConfig, targets NotifyTargetsConfig, message string) []DeliveryResult {
+	var results []DeliveryResult
+	for _, name := range NotifierNames() {
+		results = append(results, notifiers[name].Send(config, targets, message)...)
+	}
+	return results
+}
+
+// Decode parses the given notifier's settings into out, leaving it unchanged if there are none.
+func (nc NotifyConfig) Decode(name string, out interface{}) error {
+	return decodeYAML(nc.Notifiers[name], out)
+}
+
+// Decode parses the given notifier's targets into out, leaving it unchanged if there are none.
+func (t NotifyTargetsConfig) Decode(name string, out interface{}) error {
+	return decodeYAML(t[name], out)
+}
+
+// decodeYAML converts a section of config that was parsed generically into the given type.
+func decodeYAML(raw interface{}, out interface{}) error {
+	if raw == nil {
+		return nil
+	}
+	data, err := yaml.Marshal(raw)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(data, out)
+}
+
+// Merge returns the targets in both t and other, without duplicates.
+func (t NotifyTargetsConfig) Merge(other NotifyTargetsConfig) NotifyTargetsConfig {
+	merged := make(NotifyTargetsConfig)
+	for _, targets := range []NotifyTargetsConfig{t, other} {
+		for name, raw := range targets {
+			if raw == nil {
+				continue
+			}
+			list, isList := raw.([]interface{})
+			if !isList {
+				list = []interface{}{raw}
+			}
+
+			existing, _ := merged[name].([]interface{})
+			for _, target := range list {
+				var seen bool
+				for _, existingTarget := range existing {
+					if reflect.DeepEqual(existingTarget, target) {
+						seen = true
+						break
+					}
+				}
+				if !seen {
+					existing = append(existing, target)
+				}
+			}
+			merged[name] = existing
+		}
+	}
+	return merged
+}
+
+// Apply returns the given targets, modified according to this config's mode.
+func (snc ServiceNotifyConfig) Apply(targets NotifyTargetsConfig) NotifyTargetsConfig {
+	switch snc.Mode {
+	case NotifyModeNone:
+		return NotifyTargetsConfig{}
+	case NotifyModeReplace:
+		return NotifyTargetsConfig{}.Merge(snc.Targets)
+	default:
+		return targets.Merge(snc.Targets)
+	}
+}
+
+func (snc ServiceNotifyConfig) validate(config NotifyConfig) error {
+	switch snc.Mode {
+	case "", NotifyModeAdd, NotifyModeReplace, NotifyModeNone:
+	default:
+		return fmt.Errorf("Unknown mode [%s]", snc.Mode)
+	}
+	return ValidateNotifiers(config, snc.Targets)
+}
+
+// serviceNotify returns the mode and targets this route applies to matching services.
+func (route NotifyRouteConfig) serviceNotify() ServiceNotifyConfig {
+	return ServiceNotifyConfig{
+		Mode:    route.Mode,
+		Targets: route.Targets,
+	}
+}
+
+// Matches returns true if this route applies to the given service.
+func (route NotifyRouteConfig) Matches(section, name string, tags []string) bool {
+	if route.Section != "" && route.Section != section {
+		return false
+	}
+
+	if route.Name != "" {
+		// pattern is checked when loading the config
+		matched, _ := path.Match(route.Name, name)
+		if !matched {
+			return false
+		}
+	}
+
+	if len(route.Tags) < 1 {
+		return true
+	}
+	for _, routeTag := range route.Tags {
+		for _, tag := range tags {
+			if routeTag == tag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (route NotifyRouteConfig) validate(config NotifyConfig) error {
+	if route.Name != "" {
+		_, err := path.Match(route.Name, "")
+		if err != nil {
+			return fmt.Errorf("Bad name pattern [%s]: %s", route.Name, err.Error())
+		}
+	}
+	return route.serviceNotify().validate(config)
+}
+
+// TargetsFor returns the targets to notify about the given service, after applying the
+// routing rules in order and then the service's own notify config.
+func (nc NotifyConfig) TargetsFor(section, name string, tags []string, serviceNotify ServiceNotifyConfig) NotifyTargetsConfig {
+	targets := nc.DefaultTargets
+	for _, route := range nc.Routes {
+		if route.Matches(section, name, tags) {
+			targets = route.serviceNotify().Apply(targets)
+		}
+	}
+	return serviceNotify.Apply(targets)
+}
@@ -11,12 +11,29 @@ import (
 
 const (
 	keyDowntimeCount            = "ongoing.downtime.count %s %s"
+	keyDowntimeStarted          = "ongoing.downtime.started %s %s"
+	keyDowntimeAlertCount       = "ongoing.alert.count %s %s"
 	keyDowntimeLastNotification = "ongoing.last.notification %s %s"
+	keyDowntimeThreshold        = "ongoing.threshold %s %s"
 )
 
+// Downtime describes a period of time where a service was marked as down.
+type Downtime struct {
+	Started  time.Time
+	Ended    time.Time
+	Failures int
+	Alerts   int
+}
+
+// Duration returns how long the downtime lasted.
+func (d Downtime) Duration() time.Duration {
+	return d.Ended.Sub(d.Started)
+}
+
 // MarkDown marks the given service as being down in the datastore.
 func MarkDown(db *buntdb.DB, section, name string) {
 	downtimeCountKey := fmt.Sprintf(keyDowntimeCount, section, name)
+	downtimeStartedKey := fmt.Sprintf(keyDowntimeStarted, section, name)
 	err := db.Update(func(tx *buntdb.Tx) error {
 		var lastCount int
 		val, err := tx.Get(downtimeCountKey)
@@ -27,6 +44,12 @@ func MarkDown(db *buntdb.DB, section, name string) {
 
 		tx.Set(downtimeCountKey, strconv.Itoa(lastCount+1), nil)
 
+		// record when this downtime started
+		_, err = tx.Get(downtimeStartedKey)
+		if err == buntdb.ErrNotFound {
+			tx.Set(downtimeStartedKey, strconv.FormatInt(time.Now().Unix(), 10), nil)
+		}
+
 		return nil
 	})
 
@@ -35,19 +58,112 @@ func MarkDown(db *buntdb.DB, section, name string) {
 	}
 }
 
-// MarkUp marks the given service as being up in the datastore.
-func MarkUp(db *buntdb.DB, section, name string) {
+// MarkAlerted records that an alert has been sent about the given service's ongoing downtime.
+func MarkAlerted(db *buntdb.DB, section, name string) {
+	downtimeAlertCountKey := fmt.Sprintf(keyDowntimeAlertCount, section, name)
+	downtimeLastNotificationKey := fmt.Sprintf(keyDowntimeLastNotification, section, name)
+	err := db.Update(func(tx *buntdb.Tx) error {
+		markAlerted(tx, downtimeAlertCountKey, downtimeLastNotificationKey)
+		return nil
+	})
+
+	if err != nil {
+		fmt.Println("Couldn't write update:", err.Error())
+	}
+}
+
+func markAlerted(tx *buntdb.Tx, downtimeAlertCountKey, downtimeLastNotificationKey string) {
+	var alerts int
+	val, err := tx.Get(downtimeAlertCountKey)
+	if err == nil {
+		// err doesn't matter here, it'll just return 0 anyway
+		alerts, _ = strconv.Atoi(val)
+	}
+
+	tx.Set(downtimeAlertCountKey, strconv.Itoa(alerts+1), nil)
+	tx.Set(downtimeLastNotificationKey, strconv.FormatInt(time.Now().Unix(), 10), nil)
+}
+
+// MarkUp marks the given service as being up in the datastore. If the service was down, it
+// returns details of the downtime that just ended.
+func MarkUp(db *buntdb.DB, section, name string) *Downtime {
+	var downtime *Downtime
+
 	downtimeCountKey := fmt.Sprintf(keyDowntimeCount, section, name)
+	downtimeStartedKey := fmt.Sprintf(keyDowntimeStarted, section, name)
+	downtimeAlertCountKey := fmt.Sprintf(keyDowntimeAlertCount, section, name)
 	downtimeLastNotificationKey := fmt.Sprintf(keyDowntimeLastNotification, section, name)
+	downtimeThresholdKey := fmt.Sprintf(keyDowntimeThreshold, section, name)
 	err := db.Update(func(tx *buntdb.Tx) error {
+		val, err := tx.Get(downtimeCountKey)
+		if err == nil {
+			downtime = &Downtime{
+				Ended: time.Now(),
+			}
+			downtime.Failures, _ = strconv.Atoi(val)
+
+			val, err = tx.Get(downtimeStartedKey)
+			if err == nil {
+				i, err := strconv.ParseInt(val, 10, 64)
+				if err == nil {
+					downtime.Started = time.Unix(i, 0)
+				}
+			}
+			if downtime.Started.IsZero() {
+				// stored before we recorded start times
+				downtime.Started = downtime.Ended
+			}
+
+			val, err = tx.Get(downtimeAlertCountKey)
+			if err == nil {
+				downtime.Alerts, _ = strconv.Atoi(val)
+			}
+		}
+
 		tx.Delete(downtimeCountKey)
+		tx.Delete(downtimeStartedKey)
+		tx.Delete(downtimeAlertCountKey)
 		tx.Delete(downtimeLastNotificationKey)
+		tx.Delete(downtimeThresholdKey)
+		return nil
+	})
+
+	if err != nil {
+		fmt.Println("Couldn't write update:", err.Error())
+	}
+	return downtime
+}
+
+// ShouldAlertThreshold returns true if the given service has crossed a lower warning threshold than the
+// one we last alerted about (e.g. a certificate now expiring in under 7 days, rather than under 21 days).
+// Thresholds are cleared by MarkUp.
+func ShouldAlertThreshold(db *buntdb.DB, section, name string, threshold time.Duration) bool {
+	var shouldAlert bool
+
+	downtimeThresholdKey := fmt.Sprintf(keyDowntimeThreshold, section, name)
+	downtimeAlertCountKey := fmt.Sprintf(keyDowntimeAlertCount, section, name)
+	downtimeLastNotificationKey := fmt.Sprintf(keyDowntimeLastNotification, section, name)
+	err := db.Update(func(tx *buntdb.Tx) error {
+		val, err := tx.Get(downtimeThresholdKey)
+		if err == nil {
+			lastThreshold, err := strconv.ParseInt(val, 10, 64)
+			shouldAlert = err != nil || threshold < time.Duration(lastThreshold)
+		} else {
+			shouldAlert = true
+		}
+
+		if shouldAlert {
+			tx.Set(downtimeThresholdKey, strconv.FormatInt(int64(threshold), 10), nil)
+			markAlerted(tx, downtimeAlertCountKey, downtimeLastNotificationKey)
+		}
+
 		return nil
 	})
 
 	if err != nil {
 		fmt.Println("Couldn't write update:", err.Error())
 	}
+	return shouldAlert
 }
 
 // ShouldAlertDowntime returns true if the alerter should send an alert for the given service.
@@ -55,6 +171,7 @@ func ShouldAlertDowntime(db *buntdb.DB, config OngoingConfig, section, name stri
 	var shouldAlert bool
 
 	downtimeCountKey := fmt.Sprintf(keyDowntimeCount, section, name)
+	downtimeAlertCountKey := fmt.Sprintf(keyDowntimeAlertCount, section, name)
 	downtimeLastNotificationKey := fmt.Sprintf(keyDowntimeLastNotification, section, name)
 	err := db.Update(func(tx *buntdb.Tx) error {
 		var downtimeCounts int
@@ -87,9 +204,9 @@ func ShouldAlertDowntime(db *buntdb.DB, config OngoingConfig, section, name stri
 			shouldAlert = true
 		}
 
-		// update last notification time key
+		// update last notification time and alert count keys
 		if shouldAlert {
-			tx.Set(downtimeLastNotificationKey, strconv.FormatInt(time.Now().Unix(), 10), nil)
+			markAlerted(tx, downtimeAlertCountKey, downtimeLastNotificationKey)
 		}
 
 		return nil
@@ -0,0 +1,669 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testOpenVPNStaticKey returns a static key whose bytes count up from 0, so each slot is easy to tell apart.
+func testOpenVPNStaticKey() []byte {
+	key := make([]byte, openVPNStaticKeySize)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	return key
+}
+
+// testOpenVPNStaticKeyFile returns the given key in the format written by openvpn --genkey.
+func testOpenVPNStaticKeyFile(key []byte) []byte {
+	var file strings.Builder
+	file.WriteString("#\n# 2048 bit OpenVPN static key\n#\n-----BEGIN OpenVPN Static key V1-----\n")
+	encoded := hex.EncodeToString(key)
+	for i := 0; i < len(encoded); i += 32 {
+		file.WriteString(encoded[i:i+32] + "\n")
+	}
+	file.WriteString("-----END OpenVPN Static key V1-----\n")
+	return []byte(file.String())
+}
+
+var testOpenVPNHeader = []byte{openVPNControlV1 << 3, 1, 2, 3, 4, 5, 6, 7, 8}
+
+func TestParseOpenVPNStaticKey(t *testing.T) {
+	key := testOpenVPNStaticKey()
+	parsed, err := ParseOpenVPNStaticKey(testOpenVPNStaticKeyFile(key))
+	if err != nil {
+		t.Fatalf("Could not parse key: %s", err.Error())
+	}
+	if !bytes.Equal(parsed, key) {
+		t.Errorf("Parsed key is %x, expected %x", parsed, key)
+	}
+
+	_, err = ParseOpenVPNStaticKey(testOpenVPNStaticKeyFile(key[:128]))
+	if err == nil {
+		t.Error("Short key was accepted")
+	}
+	_, err = ParseOpenVPNStaticKey([]byte("-----BEGIN OpenVPN Static key V1-----\nnothex\n-----END OpenVPN Static key V1-----\n"))
+	if err == nil {
+		t.Error("Key with invalid hex was accepted")
+	}
+}
+
+func TestOpenVPNTLSAuthLayout(t *testing.T) {
+	key := testOpenVPNStaticKey()
+	direction := 1
+	wrapper, err := newOpenVPNTLSAuthWrapper(key, &direction, "sha1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := []byte("body")
+	packet := wrapper.wrap(testOpenVPNHeader, body)
+	if len(packet) != 9+sha1.Size+8+len(body) {
+		t.Fatalf("Packet is %d bytes, expected %d", len(packet), 9+sha1.Size+8+len(body))
+	}
+
+	// key-direction 1 sends with the HMAC key in the second slot
+	replayID := packet[9+sha1.Size : 9+sha1.Size+8]
+	if binary.BigEndian.Uint32(replayID) != 1 {
+		t.Errorf("First packet ID is %d, expected 1", binary.BigEndian.Uint32(replayID))
+	}
+	mac := hmac.New(sha1.New, key[128+64:128+64+sha1.Size])
+	mac.Write(replayID)
+	mac.Write(testOpenVPNHeader)
+	mac.Write(body)
+	expected := append(append(append(append([]byte{}, testOpenVPNHeader...), mac.Sum(nil)...), replayID...), body...)
+	if !bytes.Equal(packet, expected) {
+		t.Errorf("Packet is %x, expected %x", packet, expected)
+	}
+
+	packet = wrapper.wrap(testOpenVPNHeader, body)
+	if binary.BigEndian.Uint32(packet[9+sha1.Size:]) != 2 {
+		t.Errorf("Second packet ID is %d, expected 2", binary.BigEndian.Uint32(packet[9+sha1.Size:]))
+	}
+}
+
+func TestOpenVPNTLSAuthRoundTrip(t *testing.T) {
+	key := testOpenVPNStaticKey()
+	clientDirection, serverDirection := 1, 0
+
+	for _, test := range []struct {
+		name            string
+		clientDirection *int
+		serverDirection *int
+		digest          string
+	}{
+		{"bidirectional", nil, nil, "SHA1"},
+		{"key-direction", &clientDirection, &serverDirection, "SHA1"},
+		{"sha256", &clientDirection, &serverDirection, "SHA256"},
+		{"sha512", &clientDirection, &serverDirection, "SHA512"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			client, err := newOpenVPNTLSAuthWrapper(key, test.clientDirection, test.digest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			server, err := newOpenVPNTLSAuthWrapper(key, test.serverDirection, test.digest)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, pair := range [][2]*openVPNTLSAuthWrapper{{client, server}, {server, client}} {
+				header, body, err := pair[1].unwrap(pair[0].wrap(testOpenVPNHeader, []byte("hello")))
+				if err != nil {
+					t.Fatalf("Could not unwrap packet: %s", err.Error())
+				}
+				if !bytes.Equal(header, testOpenVPNHeader) || string(body) != "hello" {
+					t.Errorf("Unwrapped %x %q, expected %x %q", header, body, testOpenVPNHeader, "hello")
+				}
+			}
+
+			packet := client.wrap(testOpenVPNHeader, []byte("hello"))
+			packet[len(packet)-1] ^= 1
+			_, _, err = server.unwrap(packet)
+			if err == nil {
+				t.Error("Tampered packet was accepted")
+			}
+			_, _, err = server.unwrap(packet[:20])
+			if err == nil {
+				t.Error("Truncated packet was accepted")
+			}
+		})
+	}
+
+	// both ends using the same direction means they use different keys
+	client, _ := newOpenVPNTLSAuthWrapper(key, &clientDirection, "SHA1")
+	_, _, err := client.unwrap(client.wrap(testOpenVPNHeader, []byte("hello")))
+	if err == nil {
+		t.Error("Packet sent with the wrong key-direction was accepted")
+	}
+
+	_, err = newOpenVPNTLSAuthWrapper(key, nil, "MD4")
+	if err == nil {
+		t.Error("Unsupported digest was accepted")
+	}
+}
+
+// testOpenVPNTLSCryptServer returns a tls-crypt wrapper for the server's end, which has the keys swapped.
+func testOpenVPNTLSCryptServer(key []byte) *openVPNTLSCryptWrapper {
+	client := newOpenVPNTLSCryptWrapper(key)
+	return &openVPNTLSCryptWrapper{
+		sendCipherKey: client.recvCipherKey,
+		sendHMACKey:   client.recvHMACKey,
+		recvCipherKey: client.sendCipherKey,
+		recvHMACKey:   client.sendHMACKey,
+	}
+}
+
+func TestOpenVPNTLSCryptLayout(t *testing.T) {
+	key := testOpenVPNStaticKey()
+	wrapper := newOpenVPNTLSCryptWrapper(key)
+
+	body := []byte("some control channel data")
+	packet := wrapper.wrap(testOpenVPNHeader, body)
+	if len(packet) != 9+8+32+len(body) {
+		t.Fatalf("Packet is %d bytes, expected %d", len(packet), 9+8+32+len(body))
+	}
+
+	// clients send with the second slot: HMAC-SHA256 over the plaintext, and AES-256-CTR keyed by the tag
+	replayID := packet[9:17]
+	mac := hmac.New(sha256.New, key[128+64:128+64+32])
+	mac.Write(testOpenVPNHeader)
+	mac.Write(replayID)
+	mac.Write(body)
+	tag := mac.Sum(nil)
+	block, err := aes.NewCipher(key[128 : 128+32])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext := make([]byte, len(body))
+	cipher.NewCTR(block, tag[:aes.BlockSize]).XORKeyStream(ciphertext, body)
+
+	expected := append(append(append(append([]byte{}, testOpenVPNHeader...), replayID...), tag...), ciphertext...)
+	if !bytes.Equal(packet, expected) {
+		t.Errorf("Packet is %x, expected %x", packet, expected)
+	}
+	if bytes.Contains(packet, body) {
+		t.Error("Packet contains the plaintext body")
+	}
+}
+
+func TestOpenVPNTLSCryptRoundTrip(t *testing.T) {
+	key := testOpenVPNStaticKey()
+	client := newOpenVPNTLSCryptWrapper(key)
+	server := testOpenVPNTLSCryptServer(key)
+
+	for _, pair := range [][2]*openVPNTLSCryptWrapper{{client, server}, {server, client}} {
+		header, body, err := pair[1].unwrap(pair[0].wrap(testOpenVPNHeader, []byte("hello")))
+		if err != nil {
+			t.Fatalf("Could not unwrap packet: %s", err.Error())
+		}
+		if !bytes.Equal(header, testOpenVPNHeader) || string(body) != "hello" {
+			t.Errorf("Unwrapped %x %q, expected %x %q", header, body, testOpenVPNHeader, "hello")
+		}
+	}
+
+	for _, offset := range []int{0, 9, 17, 9 + 8 + 32} {
+		packet := client.wrap(testOpenVPNHeader, []byte("hello"))
+		packet[offset] ^= 1
+		_, _, err := server.unwrap(packet)
+		if err == nil {
+			t.Errorf("Packet tampered at byte %d was accepted", offset)
+		}
+	}
+
+	// clients only ever receive with the first slot, so they can't read their own packets
+	_, _, err := client.unwrap(client.wrap(testOpenVPNHeader, []byte("hello")))
+	if err == nil {
+		t.Error("Packet encrypted with the client's key was accepted by the client")
+	}
+}
+
+// testOpenVPNChannel returns a control channel with fixed session IDs that doesn't have a connection.
+func testOpenVPNChannel(t *testing.T) *openVPNControlChannel {
+	channel, err := newOpenVPNControlChannel(nil, false, &openVPNPlainWrapper{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	channel.localSessionID = []byte{1, 1, 1, 1, 1, 1, 1, 1}
+	return channel
+}
+
+// testOpenVPNServerPacket returns a packet from the server with session ID 2,2,2,2,2,2,2,2.
+func testOpenVPNServerPacket(opcode byte, acks []uint32, ackedSession []byte, packetID uint32, payload []byte) []byte {
+	packet := []byte{opcode << 3, 2, 2, 2, 2, 2, 2, 2, 2, byte(len(acks))}
+	for _, id := range acks {
+		packet = binary.BigEndian.AppendUint32(packet, id)
+	}
+	if len(acks) > 0 {
+		packet = append(packet, ackedSession...)
+	}
+	if opcode != openVPNAckV1 {
+		packet = binary.BigEndian.AppendUint32(packet, packetID)
+	}
+	return append(packet, payload...)
+}
+
+func TestOpenVPNBuildPacket(t *testing.T) {
+	channel := testOpenVPNChannel(t)
+
+	packet := channel.buildPacket(openVPNControlHardResetClientV2, 0, nil)
+	expected := []byte{0x38, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0}
+	if !bytes.Equal(packet, expected) {
+		t.Errorf("Reset packet is %x, expected %x", packet, expected)
+	}
+
+	channel.remoteSessionID = []byte{2, 2, 2, 2, 2, 2, 2, 2}
+	channel.pendingAcks = []uint32{0, 1}
+	packet = channel.buildPacket(openVPNControlV1, 5, []byte("tls"))
+	expected = []byte{0x20, 1, 1, 1, 1, 1, 1, 1, 1, 2, 0, 0, 0, 0, 0, 0, 0, 1, 2, 2, 2, 2, 2, 2, 2, 2, 0, 0, 0, 5, 't', 'l', 's'}
+	if !bytes.Equal(packet, expected) {
+		t.Errorf("Control packet is %x, expected %x", packet, expected)
+	}
+	if len(channel.pendingAcks) != 0 {
+		t.Errorf("%d acks still pending after sending them", len(channel.pendingAcks))
+	}
+
+	// acks have no packet ID, and only a limited number fit in each packet
+	for i := uint32(0); i < openVPNMaxAcks+2; i++ {
+		channel.pendingAcks = append(channel.pendingAcks, i)
+	}
+	packet = channel.buildPacket(openVPNAckV1, 0, nil)
+	if packet[0] != 0x28 || packet[9] != openVPNMaxAcks || len(packet) != 9+1+openVPNMaxAcks*4+8 {
+		t.Errorf("Ack packet is %x, expected %d acks and no packet ID", packet, openVPNMaxAcks)
+	}
+	if len(channel.pendingAcks) != 2 {
+		t.Errorf("%d acks still pending, expected 2", len(channel.pendingAcks))
+	}
+}
+
+func TestOpenVPNHandlePacket(t *testing.T) {
+	channel := testOpenVPNChannel(t)
+	channel.unacked[0] = openVPNUnackedPacket{opcode: openVPNControlHardResetClientV2}
+
+	err := channel.handlePacket(testOpenVPNServerPacket(openVPNControlV1, nil, nil, 1, []byte("early")))
+	if err == nil {
+		t.Error("Control data before the server's reset was accepted")
+	}
+
+	err = channel.handlePacket(testOpenVPNServerPacket(openVPNControlHardResetServerV2, []uint32{0}, []byte{9, 9, 9, 9, 9, 9, 9, 9}, 0, nil))
+	if err == nil {
+		t.Error("Ack for a different session was accepted")
+	}
+
+	err = channel.handlePacket(testOpenVPNServerPacket(openVPNControlHardResetServerV2, []uint32{0}, channel.localSessionID, 0, nil))
+	if err != nil {
+		t.Fatalf("Could not handle server reset: %s", err.Error())
+	}
+	if !channel.gotServerReset || !bytes.Equal(channel.remoteSessionID, []byte{2, 2, 2, 2, 2, 2, 2, 2}) {
+		t.Errorf("Server reset wasn't recorded, remote session is %x", channel.remoteSessionID)
+	}
+	if len(channel.unacked) != 0 {
+		t.Errorf("Our reset is still unacked")
+	}
+
+	// data arriving out of order is only read once the gap is filled, and duplicates are acked again
+	for _, id := range []uint32{2, 1, 1, 3} {
+		err = channel.handlePacket(testOpenVPNServerPacket(openVPNControlV1, nil, nil, id, []byte{'a' + byte(id)}))
+		if err != nil {
+			t.Fatalf("Could not handle packet %d: %s", id, err.Error())
+		}
+		if id == 2 && len(channel.readBuffer) != 0 {
+			t.Errorf("Packet 2 was read before packet 1")
+		}
+	}
+	if string(channel.readBuffer) != "bcd" {
+		t.Errorf("Read %q, expected %q", channel.readBuffer, "bcd")
+	}
+	expectedAcks := []uint32{0, 2, 1, 1, 3}
+	if len(channel.pendingAcks) != len(expectedAcks) {
+		t.Errorf("Pending acks are %v, expected %v", channel.pendingAcks, expectedAcks)
+	}
+
+	err = channel.handlePacket([]byte{openVPNControlV1 << 3, 9, 9, 9, 9, 9, 9, 9, 9, 0, 0, 0, 0, 4})
+	if err == nil {
+		t.Error("Packet for a different session was accepted")
+	}
+	err = channel.handlePacket(testOpenVPNServerPacket(openVPNControlHardResetClientV2, nil, nil, 5, nil))
+	if err == nil {
+		t.Error("Packet with an unexpected opcode was accepted")
+	}
+	err = channel.handlePacket(testOpenVPNServerPacket(openVPNControlV1, nil, nil, 0, nil)[:11])
+	if err == nil {
+		t.Error("Truncated packet was accepted")
+	}
+}
+
+func TestOpenVPNKeyMethod2(t *testing.T) {
+	message, err := openVPNKeyMethod2("UDPv4", &UserPassCredentialConfig{Username: "user", Password: "pass"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(message[:5], []byte{0, 0, 0, 0, 2}) {
+		t.Errorf("Message starts with %x, expected key method 2", message[:5])
+	}
+
+	reader := bytes.NewReader(message[5+48+32+32:])
+	options := readTestOpenVPNString(t, reader)
+	if !strings.Contains(options, "proto UDPv4") || !strings.Contains(options, "key-method 2") {
+		t.Errorf("Options are %q", options)
+	}
+	if username := readTestOpenVPNString(t, reader); username != "user" {
+		t.Errorf("Username is %q, expected %q", username, "user")
+	}
+	if password := readTestOpenVPNString(t, reader); password != "pass" {
+		t.Errorf("Password is %q, expected %q", password, "pass")
+	}
+	if peerInfo := readTestOpenVPNString(t, reader); peerInfo != openVPNPeerInfo {
+		t.Errorf("Peer info is %q, expected %q", peerInfo, openVPNPeerInfo)
+	}
+
+	// without credentials, the username and password are empty strings with no terminator
+	message, err = openVPNKeyMethod2("TCPv4", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader = bytes.NewReader(message[5+48+32+32:])
+	readTestOpenVPNString(t, reader)
+	rest, _ := io.ReadAll(reader)
+	if !bytes.HasPrefix(rest, []byte{0, 0, 0, 0}) {
+		t.Errorf("Empty credentials are %x, expected zero lengths", rest[:4])
+	}
+}
+
+func TestReadOpenVPNKeyMethod2(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write([]byte{0, 0, 0, 0, 2})
+	buf.Write(make([]byte, 64))
+	writeOpenVPNString(&buf, "V4,dev-type tun")
+	buf.WriteString("PUSH_REPLY\x00")
+
+	reader := bufio.NewReader(&buf)
+	err := readOpenVPNKeyMethod2(reader)
+	if err != nil {
+		t.Fatalf("Could not read key method 2: %s", err.Error())
+	}
+	next, _ := reader.ReadString(0)
+	if next != "PUSH_REPLY\x00" {
+		t.Errorf("Read past the options, next message is %q", next)
+	}
+
+	buf.Reset()
+	buf.Write([]byte{0, 0, 0, 0, 1})
+	buf.Write(make([]byte, 66))
+	err = readOpenVPNKeyMethod2(bufio.NewReader(&buf))
+	if err == nil {
+		t.Error("Key method 1 was accepted")
+	}
+}
+
+// readTestOpenVPNString reads a string written by writeOpenVPNString.
+func readTestOpenVPNString(t *testing.T, reader io.Reader) string {
+	var length uint16
+	err := binary.Read(reader, binary.BigEndian, &length)
+	if err != nil {
+		t.Fatalf("Could not read string length: %s", err.Error())
+	}
+	value := make([]byte, length)
+	_, err = io.ReadFull(reader, value)
+	if err != nil {
+		t.Fatalf("Could not read string: %s", err.Error())
+	}
+	return strings.TrimSuffix(string(value), "\x00")
+}
+
+// testOpenVPNServer is a minimal OpenVPN server over TCP. It doesn't ack anything, as clients don't
+// resend packets over TCP anyway.
+type testOpenVPNServer struct {
+	conn      net.Conn
+	wrapper   openVPNWrapper
+	sessionID []byte
+	nextID    uint32
+	tlsData   *io.PipeWriter
+	tlsReader *io.PipeReader
+}
+
+func (s *testOpenVPNServer) writePacket(opcode byte, payload []byte) error {
+	header := append([]byte{opcode << 3}, s.sessionID...)
+	body := binary.BigEndian.AppendUint32([]byte{0}, s.nextID)
+	s.nextID++
+	packet := s.wrapper.wrap(header, append(body, payload...))
+	_, err := s.conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(packet))), packet...))
+	return err
+}
+
+// readPackets passes the TLS data the client sends to tlsData, after answering its reset.
+func (s *testOpenVPNServer) readPackets() {
+	defer s.tlsData.Close()
+	for {
+		var length [2]byte
+		_, err := io.ReadFull(s.conn, length[:])
+		if err != nil {
+			return
+		}
+		packet := make([]byte, binary.BigEndian.Uint16(length[:]))
+		_, err = io.ReadFull(s.conn, packet)
+		if err != nil {
+			return
+		}
+		header, body, err := s.wrapper.unwrap(packet)
+		if err != nil {
+			s.tlsData.CloseWithError(err)
+			return
+		}
+
+		// skip the acks, as we don't need to track them
+		opcode := header[0] >> 3
+		ackCount := int(body[0])
+		body = body[1+ackCount*4:]
+		if ackCount > 0 {
+			body = body[8:]
+		}
+
+		switch opcode {
+		case openVPNControlHardResetClientV2:
+			s.writePacket(openVPNControlHardResetServerV2, nil)
+		case openVPNControlV1:
+			s.tlsData.Write(body[4:])
+		}
+	}
+}
+
+// Read reads the TLS data the client sent.
+func (s *testOpenVPNServer) Read(b []byte) (int, error) {
+	return s.tlsReader.Read(b)
+}
+
+// Write sends TLS data to the client in a single control packet.
+func (s *testOpenVPNServer) Write(b []byte) (int, error) {
+	return len(b), s.writePacket(openVPNControlV1, b)
+}
+
+func (s *testOpenVPNServer) Close() error                     { return s.conn.Close() }
+func (s *testOpenVPNServer) LocalAddr() net.Addr              { return s.conn.LocalAddr() }
+func (s *testOpenVPNServer) RemoteAddr() net.Addr             { return s.conn.RemoteAddr() }
+func (s *testOpenVPNServer) SetDeadline(time.Time) error      { return nil }
+func (s *testOpenVPNServer) SetReadDeadline(time.Time) error  { return nil }
+func (s *testOpenVPNServer) SetWriteDeadline(time.Time) error { return nil }
+
+// testOpenVPNCertificate returns a self-signed certificate for the test server.
+func testOpenVPNCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{cert}, PrivateKey: key}
+}
+
+// serveTestOpenVPN runs a single handshake on the given listener, accepting the given credential.
+func serveTestOpenVPN(t *testing.T, listener net.Listener, wrapper openVPNWrapper, cert tls.Certificate, creds UserPassCredentialConfig) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	tlsReader, tlsData := io.Pipe()
+	server := &testOpenVPNServer{
+		conn:      conn,
+		wrapper:   wrapper,
+		sessionID: []byte{2, 2, 2, 2, 2, 2, 2, 2},
+		tlsData:   tlsData,
+		tlsReader: tlsReader,
+	}
+	go server.readPackets()
+
+	tlsConn := tls.Server(server, &tls.Config{Certificates: []tls.Certificate{cert}})
+	err = tlsConn.Handshake()
+	if err != nil {
+		t.Errorf("Server TLS handshake failed: %s", err.Error())
+		return
+	}
+
+	// the client's key method 2 message
+	header := make([]byte, 5+48+32+32)
+	_, err = io.ReadFull(tlsConn, header)
+	if err != nil {
+		t.Errorf("Could not read key method 2: %s", err.Error())
+		return
+	}
+	readTestOpenVPNString(t, tlsConn)
+	username := readTestOpenVPNString(t, tlsConn)
+	password := readTestOpenVPNString(t, tlsConn)
+	readTestOpenVPNString(t, tlsConn)
+
+	var reply bytes.Buffer
+	reply.Write([]byte{0, 0, 0, 0, 2})
+	reply.Write(make([]byte, 64))
+	writeOpenVPNString(&reply, "V4,dev-type tun")
+	tlsConn.Write(reply.Bytes())
+
+	reader := bufio.NewReader(tlsConn)
+	request, err := reader.ReadString(0)
+	if err != nil || request != "PUSH_REQUEST\x00" {
+		t.Errorf("Expected a push request, got %q %v", request, err)
+		return
+	}
+	if username != creds.Username || password != creds.Password {
+		tlsConn.Write([]byte("AUTH_FAILED\x00"))
+		return
+	}
+	tlsConn.Write([]byte("PUSH_REPLY,route-gateway 10.8.0.1,ifconfig 10.8.0.2 255.255.255.0\x00"))
+}
+
+func TestOpenVPNHandshake(t *testing.T) {
+	cert := testOpenVPNCertificate(t)
+	key := testOpenVPNStaticKey()
+	serverDirection := 0
+	clientDirection := 1
+	serverTLSAuth, err := newOpenVPNTLSAuthWrapper(key, &serverDirection, "SHA256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := UserPassCredentialConfig{Username: "monitor", Password: "hunter2"}
+
+	for _, test := range []struct {
+		name    string
+		wrapper openVPNWrapper
+		config  func(config *OpenVPNConfig)
+		creds   UserPassCredentialConfig
+		auth    bool
+	}{
+		{"plain", &openVPNPlainWrapper{}, func(config *OpenVPNConfig) {}, accepted, false},
+		{"tls-auth", serverTLSAuth, func(config *OpenVPNConfig) {
+			config.TLSAuthKey = key
+			config.KeyDirection = &clientDirection
+			config.Auth = "SHA256"
+		}, accepted, false},
+		{"tls-crypt", testOpenVPNTLSCryptServer(key), func(config *OpenVPNConfig) {
+			config.TLSCryptKey = key
+		}, accepted, false},
+		{"rejected credential", &openVPNPlainWrapper{}, func(config *OpenVPNConfig) {}, UserPassCredentialConfig{Username: "monitor", Password: "wrong"}, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				serveTestOpenVPN(t, listener, test.wrapper, cert, accepted)
+			}()
+
+			address := listener.Addr().(*net.TCPAddr)
+			config := OpenVPNConfig{
+				Host:            address.IP.String(),
+				Port:            address.Port,
+				Protocol:        "tcp",
+				ClientTLSConfig: &tls.Config{InsecureSkipVerify: true},
+			}
+			test.config(&config)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			handshakeTime, err := openVPNHandshake(ctx, config, &test.creds)
+			if test.auth {
+				if !IsAuthFailure(err) {
+					t.Errorf("Expected an auth failure, got %v", err)
+				}
+			} else if err != nil {
+				t.Errorf("Handshake failed: %s", err.Error())
+			} else if handshakeTime <= 0 {
+				t.Errorf("Handshake time is %v", handshakeTime)
+			}
+			<-done
+		})
+	}
+}
+
+func TestOpenVPNHandshakeTimeout(t *testing.T) {
+	// a server that never answers our reset
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	address := conn.LocalAddr().(*net.UDPAddr)
+	config := OpenVPNConfig{
+		Host:            address.IP.String(),
+		Port:            address.Port,
+		Protocol:        "udp",
+		ClientTLSConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	_, err = openVPNHandshake(ctx, config, nil)
+	if !IsTimeout(err) {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+}
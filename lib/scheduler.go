@@ -0,0 +1,140 @@
+package lib
+
+import (
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// RunAll runs the given jobs using at most maxConcurrency goroutines, and waits for them all to finish.
+func RunAll(maxConcurrency int, jobs []func()) {
+	if maxConcurrency < 1 {
+		maxConcurrency = 1
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxConcurrency)
+	for _, job := range jobs {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(job func()) {
+			defer wg.Done()
+			job()
+			<-sem
+		}(job)
+	}
+	wg.Wait()
+}
+
+// scheduledJob is a job that's run once every interval.
+type scheduledJob struct {
+	name     string
+	interval time.Duration
+	run      func()
+	next     time.Time
+	running  bool
+}
+
+// Scheduler runs jobs on their own intervals, with some random jitter so they don't all run at once.
+type Scheduler struct {
+	maxJitter      time.Duration
+	maxConcurrency int
+	jobs           []*scheduledJob
+}
+
+// NewScheduler returns a new Scheduler that runs at most maxConcurrency jobs at a time.
+func NewScheduler(maxJitter time.Duration, maxConcurrency int) *Scheduler {
+	if maxConcurrency < 1 {
+		maxConcurrency = 1
+	}
+	return &Scheduler{
+		maxJitter:      maxJitter,
+		maxConcurrency: maxConcurrency,
+	}
+}
+
+// jitter returns a random duration between zero and the max jitter.
+func (s *Scheduler) jitter() time.Duration {
+	if s.maxJitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(s.maxJitter)))
+}
+
+// Add adds a job that runs once every interval. Its first run is after a random amount of jitter.
+func (s *Scheduler) Add(name string, interval time.Duration, run func()) {
+	s.jobs = append(s.jobs, &scheduledJob{
+		name:     name,
+		interval: interval,
+		run:      run,
+		next:     time.Now().Add(s.jitter()),
+	})
+}
+
+// nextJob returns the job that should be run next, skipping jobs that are still running.
+func (s *Scheduler) nextJob() *scheduledJob {
+	var next *scheduledJob
+	for _, job := range s.jobs {
+		if job.running {
+			continue
+		}
+		if next == nil || job.next.Before(next.next) {
+			next = job
+		}
+	}
+	return next
+}
+
+// Run runs jobs as they become due, until stop is closed. Once stopped, it waits for running jobs to finish.
+func (s *Scheduler) Run(stop <-chan struct{}) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	sem := make(chan struct{}, s.maxConcurrency)
+	done := make(chan *scheduledJob, len(s.jobs))
+
+	for {
+		job := s.nextJob()
+
+		var timer *time.Timer
+		var due <-chan time.Time
+		if job != nil {
+			timer = time.NewTimer(time.Until(job.next))
+			due = timer.C
+		}
+
+		select {
+		case <-stop:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case finished := <-done:
+			if timer != nil {
+				timer.Stop()
+			}
+			// schedule from when it finished rather than the last due time, so slow jobs don't pile up
+			finished.running = false
+			finished.next = time.Now().Add(finished.interval + s.jitter())
+			log.Println("Next run of", finished.name, "is at", finished.next.Format(time.Stamp))
+		case <-due:
+			job.running = true
+
+			// this waits for a free worker, which is what bounds our concurrency
+			select {
+			case sem <- struct{}{}:
+			case <-stop:
+				return
+			}
+
+			wg.Add(1)
+			go func(job *scheduledJob) {
+				defer wg.Done()
+				job.run()
+				<-sem
+				done <- job
+			}(job)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package slo
+
+import (
+	"time"
+)
+
+// BucketSize is how much time each Bucket covers.
+const BucketSize = 5 * time.Minute
+
+// Bucket counts the tests performed in a BucketSize period, so that error budgets can be calculated over
+// much longer periods than we keep full history for.
+type Bucket struct {
+	Start  time.Time `json:"start"`
+	Total  int       `json:"total"`
+	Failed int       `json:"failed,omitempty"`
+}
+
+// BurnRateRule alerts when the error budget is being used up at least BurnRate times faster than it can
+// be sustained, over both the long and short windows. The long window stops brief blips alerting, and
+// the short window stops us alerting long after the problem's gone.
+type BurnRateRule struct {
+	LongWindow  time.Duration
+	ShortWindow time.Duration
+	BurnRate    float64
+}
+
+// BurnRateAlert describes a BurnRateRule that's currently firing.
+type BurnRateAlert struct {
+	Rule          BurnRateRule
+	LongBurnRate  float64
+	ShortBurnRate float64
+}
+
+// addToBuckets counts the given entry in our buckets.
+func (t *Tracker[M]) addToBuckets(entry Entry[M]) {
+	if entry.Excluded {
+		return
+	}
+
+	start := entry.RecordedTime.Truncate(BucketSize)
+
+	// entries almost always arrive in order, so look from the end
+	i := len(t.Buckets)
+	for i > 0 && t.Buckets[i-1].Start.After(start) {
+		i--
+	}
+	if i < 1 || !t.Buckets[i-1].Start.Equal(start) {
+		t.Buckets = append(t.Buckets, Bucket{})
+		copy(t.Buckets[i+1:], t.Buckets[i:])
+		t.Buckets[i] = Bucket{Start: start}
+		i++
+	}
+
+	t.Buckets[i-1].Total++
+	if entry.Failed {
+		t.Buckets[i-1].Failed++
+	}
+}
+
+// CullBuckets removes buckets that end before the given time.
+func (t *Tracker[M]) CullBuckets(earliestTimeToKeep time.Time) {
+	var newBuckets []Bucket
+	for _, bucket := range t.Buckets {
+		if bucket.Start.Add(BucketSize).After(earliestTimeToKeep) {
+			newBuckets = append(newBuckets, bucket)
+		}
+	}
+	t.Buckets = newBuckets
+}
+
+// ErrorRate returns the fraction of tests that failed since the given time, and how many tests there were.
+// Our full history is used if it goes back far enough, otherwise buckets are used, which may include up
+// to BucketSize of tests from before since.
+func (t *Tracker[M]) ErrorRate(since time.Time) (float64, int) {
+	var total, failed int
+
+	if len(t.History) > 0 && !t.History[0].RecordedTime.After(since) {
+		for _, info := range t.History {
+			if info.Excluded || !info.RecordedTime.After(since) {
+				continue
+			}
+			total++
+			if info.Failed {
+				failed++
+			}
+		}
+	} else {
+		for _, bucket := range t.Buckets {
+			if bucket.Start.Add(BucketSize).After(since) {
+				total += bucket.Total
+				failed += bucket.Failed
+			}
+		}
+	}
+
+	if total < 1 {
+		return 0, 0
+	}
+	return float64(failed) / float64(total), total
+}
+
+// BurnRate returns how many times faster than sustainable the error budget for the given target has
+// been used up over the given window. A burn rate of 1 uses up the budget exactly at the end of the
+// compliance period.
+func (t *Tracker[M]) BurnRate(now time.Time, window time.Duration, target float64) float64 {
+	errorRate, _ := t.ErrorRate(now.Add(-window))
+	return errorRate / (1 - target)
+}
+
+// RemainingErrorBudget returns the fraction of the error budget for the given target that's left over
+// the compliance period. It's negative once the budget has been used up.
+func (t *Tracker[M]) RemainingErrorBudget(now time.Time, period time.Duration, target float64) float64 {
+	errorRate, _ := t.ErrorRate(now.Add(-period))
+	return 1 - errorRate/(1-target)
+}
+
+// FiringBurnRate returns the first of the given rules that's currently firing, or nil if none are.
+func (t *Tracker[M]) FiringBurnRate(now time.Time, target float64, rules []BurnRateRule) *BurnRateAlert {
+	for _, rule := range rules {
+		longBurnRate := t.BurnRate(now, rule.LongWindow, target)
+		if longBurnRate < rule.BurnRate {
+			continue
+		}
+		shortBurnRate := t.BurnRate(now, rule.ShortWindow, target)
+		if shortBurnRate < rule.BurnRate {
+			continue
+		}
+		return &BurnRateAlert{
+			Rule:          rule,
+			LongBurnRate:  longBurnRate,
+			ShortBurnRate: shortBurnRate,
+		}
+	}
+	return nil
+}
@@ -8,177 +8,207 @@ import (
 	"code.cloudfoundry.org/bytefmt"
 )
 
-// DownloadHistoryEntry represents a single attempt at downloading something.
-type DownloadHistoryEntry struct {
-	RecordedTime   time.Time `json:"time"`
-	Failed         bool
-	FailMessage    string `json:"fail-msg"`
-	BytesPerSecond uint64 `json:"bytes-per-second"`
+// Phases of a test download, that are timed separately. Not every monitor can time every phase.
+const (
+	// PhaseProxyConnect is connecting to the proxy.
+	PhaseProxyConnect = "proxy-connect"
+	// PhaseProxyAuth is authenticating with the proxy.
+	PhaseProxyAuth = "proxy-auth"
+	// PhaseTunnelConnect is the proxy connecting to the download's host.
+	PhaseTunnelConnect = "tunnel-connect"
+	// PhaseFirstByte is from sending the request until the first byte of the response arrives.
+	PhaseFirstByte = "first-byte"
+	// PhaseTransfer is reading the response body.
+	PhaseTransfer = "transfer"
+)
+
+// DownloadPhases are the phases that can be used in SLO targets.
+var DownloadPhases = []string{PhaseProxyConnect, PhaseProxyAuth, PhaseTunnelConnect, PhaseFirstByte, PhaseTransfer}
+
+// DownloadMeasurement is what we measure for a single attempt at downloading something.
+type DownloadMeasurement struct {
+	BytesPerSecond uint64                   `json:"bytes-per-second,omitempty"`
+	Phases         map[string]time.Duration `json:"phases,omitempty"`
+	// EgressFailed is set when traffic didn't exit where we expected, or DNS lookups could leak.
+	EgressFailed bool `json:"egress-failed,omitempty"`
 }
 
 // DownloadTracker tracks uptime/speed data and SLO objectives.
 type DownloadTracker struct {
-	History []DownloadHistoryEntry
+	Tracker[DownloadMeasurement]
 }
 
 // NewDownloadTracker returns a new DownloadTracker.
 func NewDownloadTracker() *DownloadTracker {
-	return &DownloadTracker{}
+	return &DownloadTracker{
+		Tracker: *NewTracker[DownloadMeasurement](),
+	}
+}
+
+// legacyDownloadHistoryEntry is how downloads were stored before the generic Tracker existed.
+type legacyDownloadHistoryEntry struct {
+	RecordedTime   time.Time `json:"time"`
+	Failed         bool
+	TimedOut       bool                     `json:"timed-out,omitempty"`
+	FailMessage    string                   `json:"fail-msg"`
+	BytesPerSecond uint64                   `json:"bytes-per-second"`
+	Phases         map[string]time.Duration `json:"phases,omitempty"`
+	Credential     string                   `json:"credential,omitempty"`
+	AuthFailed     bool                     `json:"auth-failed,omitempty"`
+	EgressFailed   bool                     `json:"egress-failed,omitempty"`
 }
 
-// LoadDownloadTrackerFromString returns a DownloadTracker instance, from a string representation created by ToString.
+// LoadDownloadTrackerFromString returns a DownloadTracker instance, from a string representation created by String.
+// Trackers stored in the legacy format are converted.
 func LoadDownloadTrackerFromString(representation string) (*DownloadTracker, error) {
 	var t *DownloadTracker
 	err := json.Unmarshal([]byte(representation), &t)
-	return t, err
+	if err != nil || t == nil || t.Version > 1 {
+		return t, err
+	}
+	if t.Version == 1 {
+		return t, loadV1Credentials(t, representation)
+	}
+
+	var legacy struct {
+		History []legacyDownloadHistoryEntry
+	}
+	err = json.Unmarshal([]byte(representation), &legacy)
+	if err != nil {
+		return nil, err
+	}
+
+	t = NewDownloadTracker()
+	for _, info := range legacy.History {
+		t.AddEntry(Entry[DownloadMeasurement]{
+			RecordedTime: info.RecordedTime,
+			Failed:       info.Failed,
+			TimedOut:     info.TimedOut,
+			Excluded:     info.AuthFailed,
+			FailMessage:  info.FailMessage,
+			Credential:   info.Credential,
+			AuthFailed:   info.AuthFailed,
+			Measurement: DownloadMeasurement{
+				BytesPerSecond: info.BytesPerSecond,
+				Phases:         info.Phases,
+				EgressFailed:   info.EgressFailed,
+			},
+		})
+	}
+	return t, nil
 }
 
-// String returns a string representation of DownloadTracker.
-func (t *DownloadTracker) String() string {
-	trackerString, _ := json.Marshal(t)
-	return string(trackerString)
+// loadV1Credentials moves the credentials of a version 1 tracker from each measurement to its entry.
+func loadV1Credentials(t *DownloadTracker, representation string) error {
+	var v1 struct {
+		History []struct {
+			Measurement struct {
+				Credential string `json:"credential"`
+				AuthFailed bool   `json:"auth-failed"`
+			} `json:"measurement"`
+		}
+	}
+	err := json.Unmarshal([]byte(representation), &v1)
+	if err != nil {
+		return err
+	}
+
+	for i, info := range v1.History {
+		t.History[i].Credential = info.Measurement.Credential
+		t.History[i].AuthFailed = info.Measurement.AuthFailed
+	}
+	t.Version = trackerVersion
+	return nil
 }
 
-// AddDownload adds a successful download to our history.
-func (t *DownloadTracker) AddDownload(recordedTime time.Time, bytesPerSecond uint64) {
-	t.History = append(t.History, DownloadHistoryEntry{
-		RecordedTime:   recordedTime,
-		Failed:         false,
+// AddDownload adds a successful download to our history, along with how long each phase took.
+func (t *DownloadTracker) AddDownload(recordedTime time.Time, bytesPerSecond uint64, phases map[string]time.Duration) {
+	t.Add(recordedTime, DownloadMeasurement{
 		BytesPerSecond: bytesPerSecond,
+		Phases:         phases,
 	})
 }
 
-// AddFailure adds a failure entry to our history.
-func (t *DownloadTracker) AddFailure(recordedTime time.Time, message string) {
-	t.History = append(t.History, DownloadHistoryEntry{
+// AddEgressFailure adds a failure entry to our history, for an attempt where the egress check failed.
+func (t *DownloadTracker) AddEgressFailure(recordedTime time.Time, message string) {
+	t.AddEntry(Entry[DownloadMeasurement]{
 		RecordedTime: recordedTime,
 		Failed:       true,
 		FailMessage:  message,
+		Measurement: DownloadMeasurement{
+			EgressFailed: true,
+		},
 	})
 }
 
-// CullHistory removes old history entries.
-func (t *DownloadTracker) CullHistory(earliestTimeToKeep time.Time) {
-	// all good
-	if len(t.History) < 1 || t.History[0].RecordedTime.After(earliestTimeToKeep) {
-		return
-	}
-
-	var newHistory []DownloadHistoryEntry
-
-	for _, info := range t.History {
-		if info.RecordedTime.After(earliestTimeToKeep) {
-			newHistory = append(newHistory, info)
+// EgressFailing returns whether the latest test failed its egress check, and its error message.
+// Auth failures are skipped, as they never get as far as the egress check.
+func (t *DownloadTracker) EgressFailing() (bool, string) {
+	for i := len(t.History) - 1; i >= 0; i-- {
+		if t.History[i].AuthFailed {
+			continue
 		}
+		return t.History[i].Measurement.EgressFailed, t.History[i].FailMessage
 	}
-
-	t.History = newHistory
-}
-
-// TotalTestsPerformed returns how many tests have been performed.
-func (t *DownloadTracker) TotalTestsPerformed() int {
-	return len(t.History)
+	return false, ""
 }
 
-// SuccessfulTestsPerformed returns how many successful tests have been performed.
-// Useful when looking at when to use results from SpeedIsAbove.
-func (t *DownloadTracker) SuccessfulTestsPerformed() int {
-	var tests int
-	for _, info := range t.History {
-		if !info.Failed {
-			tests++
-		}
-	}
-	return tests
+// SpeedIsAbove says whether enough of our downloads were faster than the given speed.
+func (t *DownloadTracker) SpeedIsAbove(minimumBytesPerSecond uint64, passTarget float64, guard Guard) bool {
+	return t.PerformanceIsAbove(func(m DownloadMeasurement) bool {
+		return minimumBytesPerSecond <= m.BytesPerSecond
+	}, passTarget, guard)
 }
 
-// ConsecutiveFailures returns the last consecutive failues and their error messages.
-func (t *DownloadTracker) ConsecutiveFailures() (int, []string) {
-	if len(t.History) < 1 || !t.History[len(t.History)-1].Failed {
-		return 0, []string{}
-	}
-
-	// not efficient, but it works and is simple to implement
-	var failErrorMessages []string
-	for _, info := range t.History {
-		if !info.Failed {
-			failErrorMessages = []string{}
-			continue
-		}
-
-		failErrorMessages = append(failErrorMessages, info.FailMessage)
-	}
+// AverageSpeed returns the average speed of all the tests we're keeping track of.
+func (t *DownloadTracker) AverageSpeed() string {
+	averageSpeedInBytes := t.Average(func(m DownloadMeasurement) float64 {
+		return float64(m.BytesPerSecond)
+	})
 
-	return len(failErrorMessages), failErrorMessages
+	return fmt.Sprintf("%s/s", bytefmt.ByteSize(uint64(averageSpeedInBytes)))
 }
 
-// UptimeIsAbove says whether the current uptime is above the given percentage.
-func (t *DownloadTracker) UptimeIsAbove(acceptableUptime float64) bool {
-	if len(t.History) < 1 {
-		return true
-	}
-
-	// generate uptime
-	var failedTests int
-	var overallTests int
-
-	for _, info := range t.History {
-		overallTests++
-		if info.Failed {
-			failedTests++
-		}
-	}
-
-	passedTests := float64(1) - (float64(failedTests) / float64(overallTests))
-
-	if passedTests > acceptableUptime {
-		return true
-	}
-	return false
+// SpeedPercentile returns the given percentile (0-100) of our download speeds. Low percentiles are the
+// slowest downloads, e.g. 90% of downloads were faster than the p10 speed.
+func (t *DownloadTracker) SpeedPercentile(percentile float64) uint64 {
+	return uint64(t.Percentile(func(m DownloadMeasurement) float64 {
+		return float64(m.BytesPerSecond)
+	}, percentile))
 }
 
-// SpeedIsAbove says whether the current uptime is above the given percentage.
-func (t *DownloadTracker) SpeedIsAbove(minimumBytesPerSecond uint64, passTarget float64) bool {
-	if len(t.History) < 1 {
-		return true
-	}
-
-	// generate uptime
-	var failedTests int
-	var overallTests int
+// SpeedPercentiles returns the median, p10 and p1 download speeds, for use in alerts.
+func (t *DownloadTracker) SpeedPercentiles() string {
+	return fmt.Sprintf("p50 is %s/s, p10 is %s/s, p1 is %s/s", bytefmt.ByteSize(t.SpeedPercentile(50)), bytefmt.ByteSize(t.SpeedPercentile(10)), bytefmt.ByteSize(t.SpeedPercentile(1)))
+}
 
-	for _, info := range t.History {
-		if info.Failed {
-			continue
+// phaseMeasurements returns the successful tests that recorded a time for the given phase.
+func (t *DownloadTracker) phaseMeasurements(phase string) []DownloadMeasurement {
+	var measurements []DownloadMeasurement
+	for _, m := range t.Successes() {
+		if _, exists := m.Phases[phase]; exists {
+			measurements = append(measurements, m)
 		}
-		overallTests++
-		if info.BytesPerSecond < minimumBytesPerSecond {
-			failedTests++
-		}
-	}
-
-	passedTests := float64(1) - (float64(failedTests) / float64(overallTests))
-
-	if passedTests > passTarget {
-		return true
 	}
-	return false
+	return measurements
 }
 
-// AverageSpeed returns the average speed of all the tests we're keeping track of.
-func (t *DownloadTracker) AverageSpeed() string {
-	var overallSpeed uint64
-	var overallTests int
-
-	for _, info := range t.History {
-		if info.Failed {
-			continue
-		}
-		overallTests++
-		overallSpeed += info.BytesPerSecond
-	}
+// PhaseTestsPerformed returns how many successful tests recorded a time for the given phase.
+func (t *DownloadTracker) PhaseTestsPerformed(phase string) int {
+	return len(t.phaseMeasurements(phase))
+}
 
-	averageSpeedInBytes := overallSpeed / uint64(overallTests)
+// PhaseIsBelow says whether the given phase took less than the given duration in enough of our tests.
+// Tests that didn't record the phase are ignored.
+func (t *DownloadTracker) PhaseIsBelow(phase string, maximum time.Duration, passTarget float64, guard Guard) bool {
+	return PassRateIsAbove(t.phaseMeasurements(phase), func(m DownloadMeasurement) bool {
+		return m.Phases[phase] <= maximum
+	}, passTarget, guard)
+}
 
-	return fmt.Sprintf("%s/s", bytefmt.ByteSize(averageSpeedInBytes))
+// AveragePhase returns the average time taken by the given phase, in the tests that recorded it.
+func (t *DownloadTracker) AveragePhase(phase string) time.Duration {
+	return time.Duration(Average(t.phaseMeasurements(phase), func(m DownloadMeasurement) float64 {
+		return float64(m.Phases[phase])
+	}))
 }
@@ -0,0 +1,43 @@
+package slo
+
+import (
+	"math"
+)
+
+// Guard stops SLOs being evaluated from too few samples. When Z is set, an SLO is only missed once
+// we're confident that it has been, using the Wilson score interval. This means small sample sizes
+// need a lot of failures before they alert, while large ones alert as soon as the target is missed.
+type Guard struct {
+	MinSamples int
+	// Z is the standard score for the confidence we need, e.g. 1.645 for 95%.
+	Z float64
+}
+
+// Missed says whether passed out of total samples misses the given target.
+func (g Guard) Missed(passed, total int, target float64) bool {
+	if total < 1 || total < g.MinSamples {
+		return false
+	}
+
+	if g.Z <= 0 {
+		return float64(passed)/float64(total) <= target
+	}
+	_, upper := WilsonBounds(passed, total, g.Z)
+	return upper <= target
+}
+
+// WilsonBounds returns the lower and upper bounds of the Wilson score interval for the pass rate of
+// passed out of total samples.
+func WilsonBounds(passed, total int, z float64) (float64, float64) {
+	if total < 1 {
+		return 0, 1
+	}
+
+	n := float64(total)
+	p := float64(passed) / n
+	denominator := 1 + z*z/n
+	centre := p + z*z/(2*n)
+	margin := z * math.Sqrt(p*(1-p)/n+z*z/(4*n*n))
+
+	return (centre - margin) / denominator, (centre + margin) / denominator
+}
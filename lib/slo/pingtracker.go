@@ -2,175 +2,121 @@ package slo
 
 import (
 	"encoding/json"
+	"fmt"
+	"math"
 	"time"
 )
 
-// PingHistoryEntry represents a single ping, whether it succeeded or failed, and the RTT.
-type PingHistoryEntry struct {
-	RecordedTime time.Time `json:"time"`
-	Failed       bool
-	RTT          time.Duration `json:"rtt"`
-}
-
-// PingTracker tracks uptime/speed data and SLO objectives.
+// PingTracker tracks uptime/RTT data and SLO objectives. It's used for anything where we measure a
+// duration, e.g. DNS query times and handshake times.
 type PingTracker struct {
-	History []PingHistoryEntry
+	Tracker[time.Duration]
 }
 
 // NewPingTracker returns a new PingTracker.
 func NewPingTracker() *PingTracker {
-	return &PingTracker{}
+	return &PingTracker{
+		Tracker: *NewTracker[time.Duration](),
+	}
+}
+
+// legacyPingHistoryEntry is how pings were stored before the generic Tracker existed.
+type legacyPingHistoryEntry struct {
+	RecordedTime time.Time `json:"time"`
+	Failed       bool
+	TimedOut     bool          `json:"timed-out,omitempty"`
+	RTT          time.Duration `json:"rtt"`
 }
 
-// LoadPingTrackerFromString returns a PingTracker instance, from a string representation created by ToString.
+// LoadPingTrackerFromString returns a PingTracker instance, from a string representation created by String.
+// Trackers stored in the legacy format are converted.
 func LoadPingTrackerFromString(representation string) (*PingTracker, error) {
 	var t *PingTracker
 	err := json.Unmarshal([]byte(representation), &t)
-	return t, err
-}
+	if err != nil || t == nil || t.Version > 0 {
+		return t, err
+	}
 
-// String returns a string representation of PingTracker.
-func (t *PingTracker) String() string {
-	trackerString, _ := json.Marshal(t)
-	return string(trackerString)
+	var legacy struct {
+		History []legacyPingHistoryEntry
+	}
+	err = json.Unmarshal([]byte(representation), &legacy)
+	if err != nil {
+		return nil, err
+	}
+
+	t = NewPingTracker()
+	for _, info := range legacy.History {
+		t.AddEntry(Entry[time.Duration]{
+			RecordedTime: info.RecordedTime,
+			Failed:       info.Failed,
+			TimedOut:     info.TimedOut,
+			Measurement:  info.RTT,
+		})
+	}
+	return t, nil
 }
 
 // AddPing adds a successful ping to our history.
 func (t *PingTracker) AddPing(recordedTime time.Time, rtt time.Duration) {
-	t.History = append(t.History, PingHistoryEntry{
-		RecordedTime: recordedTime,
-		Failed:       false,
-		RTT:          rtt,
-	})
+	t.Add(recordedTime, rtt)
 }
 
-// AddFailure adds a failure entry to our history.
-func (t *PingTracker) AddFailure(recordedTime time.Time) {
-	t.History = append(t.History, PingHistoryEntry{
-		RecordedTime: recordedTime,
-		Failed:       true,
-	})
+// RTTIsBelow says whether enough of our RTTs are below the given duration.
+func (t *PingTracker) RTTIsBelow(maximumRTT time.Duration, passTarget float64, guard Guard) bool {
+	return t.PerformanceIsAbove(func(rtt time.Duration) bool {
+		return rtt <= maximumRTT
+	}, passTarget, guard)
 }
 
-// CullHistory removes old history entries.
-func (t *PingTracker) CullHistory(earliestTimeToKeep time.Time) {
-	// all good
-	if len(t.History) < 1 || t.History[0].RecordedTime.After(earliestTimeToKeep) {
-		return
-	}
-
-	var newHistory []PingHistoryEntry
-
-	for _, info := range t.History {
-		if info.RecordedTime.After(earliestTimeToKeep) {
-			newHistory = append(newHistory, info)
-		}
-	}
-
-	t.History = newHistory
+// AverageRTT returns the average RTT of all the tests we're keeping track of.
+func (t *PingTracker) AverageRTT() time.Duration {
+	return time.Duration(t.Average(func(rtt time.Duration) float64 {
+		return float64(rtt)
+	}))
 }
 
-// TotalTestsPerformed returns how many tests have been performed.
-func (t *PingTracker) TotalTestsPerformed() int {
-	return len(t.History)
+// RTTPercentile returns the given percentile (0-100) of our RTTs.
+func (t *PingTracker) RTTPercentile(percentile float64) time.Duration {
+	return time.Duration(t.Percentile(func(rtt time.Duration) float64 {
+		return float64(rtt)
+	}, percentile))
 }
 
-// SuccessfulTestsPerformed returns how many successful tests have been performed.
-// Useful when looking at when to use results from SpeedIsAbove.
-func (t *PingTracker) SuccessfulTestsPerformed() int {
-	var tests int
-	for _, info := range t.History {
-		if !info.Failed {
-			tests++
-		}
-	}
-	return tests
+// RTTPercentiles returns the median, p95 and p99 RTTs, for use in alerts.
+func (t *PingTracker) RTTPercentiles() string {
+	return fmt.Sprintf("p50 is %v, p95 is %v, p99 is %v", t.RTTPercentile(50), t.RTTPercentile(95), t.RTTPercentile(99))
 }
 
-// ConsecutiveFailures returns the last consecutive failues and their error messages.
-func (t *PingTracker) ConsecutiveFailures() int {
-	if len(t.History) < 1 || !t.History[len(t.History)-1].Failed {
+// RTTStdDev returns the standard deviation of our RTTs.
+func (t *PingTracker) RTTStdDev() time.Duration {
+	rtts := t.Successes()
+	if len(rtts) < 2 {
 		return 0
 	}
 
-	var fails int
-	for _, info := range t.History {
-		if !info.Failed {
-			continue
-		}
-
-		fails++
-	}
-
-	return fails
-}
-
-// UptimeIsAbove says whether the current uptime is above the given percentage.
-func (t *PingTracker) UptimeIsAbove(acceptableUptime float64) bool {
-	if len(t.History) < 1 {
-		return true
-	}
-
-	// generate uptime
-	var failedTests int
-	var overallTests int
-
-	for _, info := range t.History {
-		overallTests++
-		if info.Failed {
-			failedTests++
-		}
+	mean := float64(t.AverageRTT())
+	var sumOfSquares float64
+	for _, rtt := range rtts {
+		sumOfSquares += math.Pow(float64(rtt)-mean, 2)
 	}
-
-	passedTests := float64(1) - (float64(failedTests) / float64(overallTests))
-
-	if passedTests > acceptableUptime {
-		return true
-	}
-	return false
+	return time.Duration(math.Sqrt(sumOfSquares / float64(len(rtts))))
 }
 
-// AvgRTTIsBelow says whether the average RTT is above the given duration.
-func (t *PingTracker) AvgRTTIsBelow(maximumRTT time.Duration, passTarget float64) bool {
-	if len(t.History) < 1 {
-		return true
-	}
-
-	// generate uptime
-	var failedTests int
-	var overallTests int
-
-	for _, info := range t.History {
-		if info.Failed {
-			continue
-		}
-		overallTests++
-		if info.RTT > maximumRTT {
-			failedTests++
-		}
-	}
-
-	passedTests := float64(1) - (float64(failedTests) / float64(overallTests))
-
-	if passedTests > passTarget {
-		return true
+// Jitter returns the average difference between the RTTs of consecutive successful pings.
+func (t *PingTracker) Jitter() time.Duration {
+	rtts := t.Successes()
+	if len(rtts) < 2 {
+		return 0
 	}
-	return false
-}
-
-// AverageRTT returns the average RTT of all the tests we're keeping track of.
-func (t *PingTracker) AverageRTT() time.Duration {
-	var overallRTT time.Duration
-	var overallTests int
 
-	for _, info := range t.History {
-		if info.Failed {
-			continue
+	var total time.Duration
+	for i := 1; i < len(rtts); i++ {
+		difference := rtts[i] - rtts[i-1]
+		if difference < 0 {
+			difference = -difference
 		}
-		overallTests++
-		overallRTT += info.RTT
+		total += difference
 	}
-
-	// this might be the recommended way but it feels very hacky
-	return overallRTT / time.Duration(overallTests)
+	return total / time.Duration(len(rtts)-1)
 }
@@ -0,0 +1,314 @@
+package slo
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"time"
+)
+
+// trackerVersion is the version of the JSON we store trackers as. Trackers stored before the generic
+// Tracker existed have no version, and are converted when they're loaded. Version 1 download trackers
+// recorded credentials in the measurement rather than the entry.
+const trackerVersion = 2
+
+// Entry is the result of a single test. Measurement holds what was measured, e.g. an RTT or a download
+// speed, and may also be set on failures to record details about them.
+type Entry[M any] struct {
+	RecordedTime time.Time `json:"time"`
+	Failed       bool      `json:"failed,omitempty"`
+	TimedOut     bool      `json:"timed-out,omitempty"`
+	// Excluded entries are kept in history, but don't count towards uptime or failures in a row.
+	Excluded    bool   `json:"excluded,omitempty"`
+	FailMessage string `json:"fail-msg,omitempty"`
+	// Credential is the username this test used, if any.
+	Credential string `json:"credential,omitempty"`
+	// AuthFailed is set when the service rejected the credential. These failures say something is wrong
+	// with the credential rather than the service, so they're excluded from uptime.
+	AuthFailed  bool `json:"auth-failed,omitempty"`
+	Measurement M    `json:"measurement"`
+}
+
+// Tracker tracks test results and evaluates uptime and performance SLOs against them.
+type Tracker[M any] struct {
+	Version int `json:"version"`
+	History []Entry[M]
+	// Buckets count results over longer periods than we keep History for, for error budgets.
+	Buckets []Bucket `json:"buckets,omitempty"`
+}
+
+// NewTracker returns a new Tracker.
+func NewTracker[M any]() *Tracker[M] {
+	return &Tracker[M]{
+		Version: trackerVersion,
+	}
+}
+
+// LoadTrackerFromString returns a Tracker instance, from a string representation created by String.
+func LoadTrackerFromString[M any](representation string) (*Tracker[M], error) {
+	var t *Tracker[M]
+	err := json.Unmarshal([]byte(representation), &t)
+	return t, err
+}
+
+// String returns a string representation of Tracker.
+func (t *Tracker[M]) String() string {
+	trackerString, _ := json.Marshal(t)
+	return string(trackerString)
+}
+
+// AddEntry adds the given entry to our history.
+func (t *Tracker[M]) AddEntry(entry Entry[M]) {
+	t.History = append(t.History, entry)
+	t.addToBuckets(entry)
+}
+
+// Merge adds all of the given tracker's history to ours.
+func (t *Tracker[M]) Merge(other *Tracker[M]) {
+	for _, entry := range other.History {
+		t.AddEntry(entry)
+	}
+}
+
+// Add adds a successful test to our history.
+func (t *Tracker[M]) Add(recordedTime time.Time, measurement M) {
+	t.AddEntry(Entry[M]{
+		RecordedTime: recordedTime,
+		Measurement:  measurement,
+	})
+}
+
+// AddFailure adds a failure entry to our history.
+func (t *Tracker[M]) AddFailure(recordedTime time.Time, message string) {
+	t.AddEntry(Entry[M]{
+		RecordedTime: recordedTime,
+		Failed:       true,
+		FailMessage:  message,
+	})
+}
+
+// AddTimeout adds a failure entry to our history, for a test that timed out.
+func (t *Tracker[M]) AddTimeout(recordedTime time.Time, message string) {
+	t.AddEntry(Entry[M]{
+		RecordedTime: recordedTime,
+		Failed:       true,
+		TimedOut:     true,
+		FailMessage:  message,
+	})
+}
+
+// AddAuthFailure adds a failure entry to our history, for a test where the service rejected our credential.
+func (t *Tracker[M]) AddAuthFailure(recordedTime time.Time, message string) {
+	t.AddEntry(Entry[M]{
+		RecordedTime: recordedTime,
+		Failed:       true,
+		Excluded:     true,
+		AuthFailed:   true,
+		FailMessage:  message,
+	})
+}
+
+// AttributeTo marks every entry in our history as using the given credential.
+func (t *Tracker[M]) AttributeTo(credential string) {
+	for i := range t.History {
+		t.History[i].Credential = credential
+	}
+}
+
+// Credentials returns the credentials used in our history, in the order they were first used.
+func (t *Tracker[M]) Credentials() []string {
+	var credentials []string
+	seen := make(map[string]bool)
+	for _, info := range t.History {
+		if info.Credential != "" && !seen[info.Credential] {
+			seen[info.Credential] = true
+			credentials = append(credentials, info.Credential)
+		}
+	}
+	return credentials
+}
+
+// CredentialAuthFailures returns how many times in a row the given credential has been rejected by the
+// service, and the last error message. Tests that used other credentials are ignored.
+func (t *Tracker[M]) CredentialAuthFailures(credential string) (int, string) {
+	var failures int
+	var lastMessage string
+	for i := len(t.History) - 1; i >= 0; i-- {
+		info := t.History[i]
+		if info.Credential != credential {
+			continue
+		}
+		if !info.AuthFailed {
+			break
+		}
+		if failures == 0 {
+			lastMessage = info.FailMessage
+		}
+		failures++
+	}
+	return failures, lastMessage
+}
+
+// CullHistory removes old history entries.
+func (t *Tracker[M]) CullHistory(earliestTimeToKeep time.Time) {
+	// all good
+	if len(t.History) < 1 || t.History[0].RecordedTime.After(earliestTimeToKeep) {
+		return
+	}
+
+	var newHistory []Entry[M]
+
+	for _, info := range t.History {
+		if info.RecordedTime.After(earliestTimeToKeep) {
+			newHistory = append(newHistory, info)
+		}
+	}
+
+	t.History = newHistory
+}
+
+// TotalTestsPerformed returns how many tests have been performed, not counting excluded ones.
+func (t *Tracker[M]) TotalTestsPerformed() int {
+	var tests int
+	for _, info := range t.History {
+		if !info.Excluded {
+			tests++
+		}
+	}
+	return tests
+}
+
+// SuccessfulTestsPerformed returns how many successful tests have been performed.
+// Useful when looking at when to use results from PerformanceIsAbove.
+func (t *Tracker[M]) SuccessfulTestsPerformed() int {
+	var tests int
+	for _, info := range t.History {
+		if !info.Failed {
+			tests++
+		}
+	}
+	return tests
+}
+
+// TimeoutsPerformed returns how many tests have timed out.
+func (t *Tracker[M]) TimeoutsPerformed() int {
+	var tests int
+	for _, info := range t.History {
+		if info.TimedOut {
+			tests++
+		}
+	}
+	return tests
+}
+
+// ConsecutiveFailures returns the last consecutive failures and their error messages, skipping
+// excluded entries.
+func (t *Tracker[M]) ConsecutiveFailures() (int, []string) {
+	var failErrorMessages []string
+	for i := len(t.History) - 1; i >= 0; i-- {
+		info := t.History[i]
+		if info.Excluded {
+			continue
+		}
+		if !info.Failed {
+			break
+		}
+		failErrorMessages = append([]string{info.FailMessage}, failErrorMessages...)
+	}
+
+	return len(failErrorMessages), failErrorMessages
+}
+
+// UptimeIsAbove says whether the current uptime is above the given percentage. It's always true when
+// the guard says there aren't enough samples.
+func (t *Tracker[M]) UptimeIsAbove(acceptableUptime float64, guard Guard) bool {
+	var failedTests int
+	var overallTests int
+
+	for _, info := range t.History {
+		if info.Excluded {
+			continue
+		}
+		overallTests++
+		if info.Failed {
+			failedTests++
+		}
+	}
+
+	return !guard.Missed(overallTests-failedTests, overallTests, acceptableUptime)
+}
+
+// Successes returns the measurements of our successful tests.
+func (t *Tracker[M]) Successes() []M {
+	var measurements []M
+	for _, info := range t.History {
+		if !info.Failed {
+			measurements = append(measurements, info.Measurement)
+		}
+	}
+	return measurements
+}
+
+// PerformanceIsAbove says whether more than passTarget of our successful tests were good, as decided
+// by isGood. For example, whether 90% of pings had an RTT under 100ms.
+func (t *Tracker[M]) PerformanceIsAbove(isGood func(M) bool, passTarget float64, guard Guard) bool {
+	return PassRateIsAbove(t.Successes(), isGood, passTarget, guard)
+}
+
+// Average returns the average of the given value across our successful tests.
+func (t *Tracker[M]) Average(value func(M) float64) float64 {
+	return Average(t.Successes(), value)
+}
+
+// Percentile returns the given percentile (0-100) of the given value across our successful tests.
+func (t *Tracker[M]) Percentile(value func(M) float64, percentile float64) float64 {
+	return Percentile(t.Successes(), value, percentile)
+}
+
+// PassRateIsAbove says whether more than passTarget of the given measurements are good, as decided by
+// isGood. If the guard says there aren't enough measurements, it returns true.
+func PassRateIsAbove[M any](measurements []M, isGood func(M) bool, passTarget float64, guard Guard) bool {
+	var passedTests int
+	for _, measurement := range measurements {
+		if isGood(measurement) {
+			passedTests++
+		}
+	}
+
+	return !guard.Missed(passedTests, len(measurements), passTarget)
+}
+
+// Average returns the average of the given value across the given measurements, or 0 if there are none.
+func Average[M any](measurements []M, value func(M) float64) float64 {
+	if len(measurements) < 1 {
+		return 0
+	}
+
+	var total float64
+	for _, measurement := range measurements {
+		total += value(measurement)
+	}
+	return total / float64(len(measurements))
+}
+
+// Percentile returns the given percentile (0-100) of the given value across the given measurements,
+// using the nearest-rank method, or 0 if there are none.
+func Percentile[M any](measurements []M, value func(M) float64, percentile float64) float64 {
+	if len(measurements) < 1 {
+		return 0
+	}
+
+	values := make([]float64, len(measurements))
+	for i, measurement := range measurements {
+		values[i] = value(measurement)
+	}
+	sort.Float64s(values)
+
+	rank := int(math.Ceil(percentile / 100 * float64(len(values))))
+	if rank < 1 {
+		rank = 1
+	} else if len(values) < rank {
+		rank = len(values)
+	}
+	return values[rank-1]
+}
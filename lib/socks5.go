@@ -0,0 +1,216 @@
+package lib
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/LondonTrustMedia/downtime_alert/lib/slo"
+)
+
+// SOCKS5 protocol constants, from RFC 1928 and RFC 1929.
+const (
+	socks5Version                  = 5
+	socks5UserPassVersion          = 1
+	socks5MethodNoAuth             = 0
+	socks5MethodUserPass           = 2
+	socks5MethodNoAcceptable       = 0xff
+	socks5CommandConnect           = 1
+	socks5AddressIPv4              = 1
+	socks5AddressDomain            = 3
+	socks5AddressIPv6              = 4
+	socks5ReplySucceeded           = 0
+	socks5ReplyAddressNotSupported = 8
+	socks5MaxDomainNameLength      = 255
+)
+
+var socks5ReplyMessages = map[byte]string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// socks5Dialer connects through a SOCKS5 proxy, timing each phase of setting up the connection.
+type socks5Dialer struct {
+	proxyAddress string
+	username     string
+	password     string
+	// requireRemoteDNS makes a proxy refusing to resolve hostnames an egress failure
+	requireRemoteDNS bool
+
+	// phases holds how long each phase of the last connection took
+	phases *phaseTimings
+	// remoteDNS is set if the proxy accepted a hostname for the last connection and resolved it itself
+	remoteDNS bool
+}
+
+// DialContext connects to the given address through the proxy.
+func (d *socks5Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("SOCKS5 proxies don't support network %s", network)
+	}
+
+	phaseStartedTime := time.Now()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", d.proxyAddress)
+	if err != nil {
+		return nil, fmt.Errorf("Could not connect to proxy: %w", err)
+	}
+	d.phases.Set(slo.PhaseProxyConnect, time.Since(phaseStartedTime))
+
+	if deadline, hasDeadline := ctx.Deadline(); hasDeadline {
+		conn.SetDeadline(deadline)
+	}
+	finished := closeOnDone(ctx, conn)
+
+	err = d.handshake(conn, address)
+	finished()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// handshake authenticates with the proxy and asks it to connect to the given address.
+func (d *socks5Dialer) handshake(conn net.Conn, address string) error {
+	phaseStartedTime := time.Now()
+
+	method := byte(socks5MethodNoAuth)
+	if d.username != "" {
+		method = socks5MethodUserPass
+	}
+	_, err := conn.Write([]byte{socks5Version, 1, method})
+	if err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return fmt.Errorf("Could not read proxy's greeting: %w", err)
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("Proxy replied with SOCKS version %d", reply[0])
+	}
+	if reply[1] == socks5MethodNoAcceptable || reply[1] != method {
+		return errors.New("Proxy did not accept our authentication method")
+	}
+
+	if method == socks5MethodUserPass {
+		if len(d.username) > 255 || len(d.password) > 255 {
+			return errors.New("Username and password must be at most 255 bytes")
+		}
+		request := []byte{socks5UserPassVersion, byte(len(d.username))}
+		request = append(request, d.username...)
+		request = append(request, byte(len(d.password)))
+		request = append(request, d.password...)
+		_, err = conn.Write(request)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.ReadFull(conn, reply)
+		if err != nil {
+			return fmt.Errorf("Could not read proxy's authentication reply: %w", err)
+		}
+		if reply[1] != socks5ReplySucceeded {
+			return &RequestError{Category: RequestErrorAuth, Err: fmt.Errorf("Proxy rejected credential %s", d.username)}
+		}
+	}
+	d.phases.Set(slo.PhaseProxyAuth, time.Since(phaseStartedTime))
+
+	phaseStartedTime = time.Now()
+	request, err := socks5ConnectRequest(address)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(request)
+	if err != nil {
+		return err
+	}
+
+	// reply is ver, rep, rsv, atyp, then the bound address and port, which we don't need
+	header := make([]byte, 4)
+	_, err = io.ReadFull(conn, header)
+	if err != nil {
+		return fmt.Errorf("Could not read proxy's connect reply: %w", err)
+	}
+	requestedDomain := request[3] == socks5AddressDomain
+	if header[1] == socks5ReplyAddressNotSupported && requestedDomain && d.requireRemoteDNS {
+		return &EgressError{Err: errors.New("Proxy does not resolve hostnames, so DNS lookups would be made locally")}
+	}
+	if header[1] != socks5ReplySucceeded {
+		message, exists := socks5ReplyMessages[header[1]]
+		if !exists {
+			message = fmt.Sprintf("unknown error %d", header[1])
+		}
+		return &RequestError{Category: RequestErrorConnection, Err: fmt.Errorf("Proxy could not connect to %s: %s", address, message)}
+	}
+	d.remoteDNS = requestedDomain
+
+	var addressLength int
+	switch header[3] {
+	case socks5AddressIPv4:
+		addressLength = net.IPv4len
+	case socks5AddressIPv6:
+		addressLength = net.IPv6len
+	case socks5AddressDomain:
+		_, err = io.ReadFull(conn, header[:1])
+		if err != nil {
+			return fmt.Errorf("Could not read proxy's connect reply: %w", err)
+		}
+		addressLength = int(header[0])
+	default:
+		return fmt.Errorf("Proxy replied with unknown address type %d", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, addressLength+2))
+	if err != nil {
+		return fmt.Errorf("Could not read proxy's connect reply: %w", err)
+	}
+	d.phases.Set(slo.PhaseTunnelConnect, time.Since(phaseStartedTime))
+
+	return nil
+}
+
+// socks5ConnectRequest returns a CONNECT request for the given address.
+func socks5ConnectRequest(address string) ([]byte, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid port [%s]", portString)
+	}
+
+	request := []byte{socks5Version, socks5CommandConnect, 0}
+	ip := net.ParseIP(host)
+	if ip4 := ip.To4(); ip4 != nil {
+		request = append(request, socks5AddressIPv4)
+		request = append(request, ip4...)
+	} else if ip != nil {
+		request = append(request, socks5AddressIPv6)
+		request = append(request, ip...)
+	} else {
+		if len(host) > socks5MaxDomainNameLength {
+			return nil, fmt.Errorf("Hostname is too long: %s", host)
+		}
+		request = append(request, socks5AddressDomain, byte(len(host)))
+		request = append(request, host...)
+	}
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+
+	return request, nil
+}
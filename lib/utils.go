@@ -1,7 +1,17 @@
 package lib
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/tidwall/buntdb"
 )
@@ -27,3 +37,147 @@ func GetCounter(db *buntdb.DB, key string, max int) int {
 	})
 	return counter
 }
+
+// FormatDays formats the given duration in days, e.g. "7 days".
+func FormatDays(duration time.Duration) string {
+	days := int(duration / (24 * time.Hour))
+	if days == 1 {
+		return "1 day"
+	}
+	return fmt.Sprintf("%d days", days)
+}
+
+// FormatWindow formats the given duration without trailing zero units, e.g. "1h" rather than "1h0m0s".
+// Whole days are formatted with FormatDays.
+func FormatWindow(duration time.Duration) string {
+	if duration >= 24*time.Hour && duration%(24*time.Hour) == 0 {
+		return FormatDays(duration)
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(duration.String(), "0s"), "0m")
+}
+
+// TimeoutError is returned by checks that didn't finish before their timeout.
+type TimeoutError struct {
+	Err error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("Timed out: %s", e.Err.Error())
+}
+
+// IsTimeout returns true if the given error is or wraps a TimeoutError.
+func IsTimeout(err error) bool {
+	var timeoutErr *TimeoutError
+	return errors.As(err, &timeoutErr)
+}
+
+// EgressError is returned when traffic through a proxy doesn't exit where we expect, or DNS lookups
+// could leak outside of it.
+type EgressError struct {
+	Err error
+}
+
+func (e *EgressError) Error() string {
+	return fmt.Sprintf("Egress check failed: %s", e.Err.Error())
+}
+
+// IsEgressFailure returns true if the given error is an EgressError.
+func IsEgressFailure(err error) bool {
+	var egressErr *EgressError
+	return errors.As(err, &egressErr)
+}
+
+// checkTimeout returns a TimeoutError if err was caused by the check timing out, or err otherwise.
+func checkTimeout(ctx context.Context, err error) error {
+	if err == nil || IsTimeout(err) {
+		return err
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return &TimeoutError{Err: err}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return &TimeoutError{Err: err}
+	}
+	return err
+}
+
+// closeOnDone closes the given connection when ctx is done, so that blocked reads and writes return.
+// Call the returned function once the connection is finished with.
+func closeOnDone(ctx context.Context, conn io.Closer) func() {
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-finished:
+		}
+	}()
+	return func() {
+		close(finished)
+	}
+}
+
+// Categories of RequestError.
+const (
+	RequestErrorDNS               = "DNS lookup failed"
+	RequestErrorConnectionRefused = "Connection refused"
+	RequestErrorTLS               = "TLS handshake failed"
+	RequestErrorConnection        = "Connection failed"
+	RequestErrorAuth              = "Authentication failed"
+)
+
+// RequestError is returned by checks that couldn't make their request at all, e.g. because of a DNS failure.
+type RequestError struct {
+	Category string
+	Err      error
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Category, e.Err.Error())
+}
+
+// IsAuthFailure returns true if the given error is from a proxy rejecting our credentials.
+func IsAuthFailure(err error) bool {
+	var requestErr *RequestError
+	return errors.As(err, &requestErr) && requestErr.Category == RequestErrorAuth
+}
+
+// classifyRequestError returns a TimeoutError or RequestError describing why a request failed.
+func classifyRequestError(ctx context.Context, err error) error {
+	err = checkTimeout(ctx, err)
+	if err == nil || IsTimeout(err) {
+		return err
+	}
+
+	var dnsErr *net.DNSError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certInvalidErr x509.CertificateInvalidError
+	var recordHeaderErr tls.RecordHeaderError
+	var opErr *net.OpError
+	var requestErr *RequestError
+	var egressErr *EgressError
+
+	switch {
+	case errors.As(err, &requestErr):
+		// already classified, e.g. by a proxy dialer
+		return requestErr
+	case errors.As(err, &egressErr):
+		return egressErr
+	case errors.As(err, &dnsErr):
+		return &RequestError{Category: RequestErrorDNS, Err: err}
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return &RequestError{Category: RequestErrorConnectionRefused, Err: err}
+	case errors.As(err, &unknownAuthorityErr), errors.As(err, &hostnameErr), errors.As(err, &certInvalidErr), errors.As(err, &recordHeaderErr):
+		return &RequestError{Category: RequestErrorTLS, Err: err}
+	case errors.As(err, &opErr):
+		if opErr.Op == "remote error" {
+			// tls alerts from the server look like this
+			return &RequestError{Category: RequestErrorTLS, Err: err}
+		}
+		return &RequestError{Category: RequestErrorConnection, Err: err}
+	}
+
+	return &RequestError{Category: RequestErrorConnection, Err: err}
+}
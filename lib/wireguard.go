@@ -0,0 +1,218 @@
+package lib
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// WireGuard message types and sizes.
+const (
+	wireGuardHandshakeInitiation = 1
+	wireGuardHandshakeResponse   = 2
+	wireGuardCookieReply         = 3
+
+	wireGuardInitiationSize  = 148
+	wireGuardResponseSize    = 92
+	wireGuardCookieReplySize = 64
+)
+
+var (
+	wireGuardConstruction = []byte("Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s")
+	wireGuardIdentifier   = []byte("WireGuard v1 zx2c4 Jason@zx2c4.com")
+	wireGuardLabelMAC1    = []byte("mac1----")
+	wireGuardLabelCookie  = []byte("cookie--")
+)
+
+// wireGuardTAI64NBase is the TAI64 label for the unix epoch, including the 10 second TAI offset.
+const wireGuardTAI64NBase = uint64(0x400000000000000a)
+
+func wireGuardHash(inputs ...[]byte) []byte {
+	h, _ := blake2s.New256(nil)
+	for _, input := range inputs {
+		h.Write(input)
+	}
+	return h.Sum(nil)
+}
+
+func wireGuardMAC(key []byte, input []byte) []byte {
+	h, _ := blake2s.New128(key)
+	h.Write(input)
+	return h.Sum(nil)
+}
+
+func wireGuardHMAC(key []byte, inputs ...[]byte) []byte {
+	mac := hmac.New(func() hash.Hash {
+		h, _ := blake2s.New256(nil)
+		return h
+	}, key)
+	for _, input := range inputs {
+		mac.Write(input)
+	}
+	return mac.Sum(nil)
+}
+
+// wireGuardKDF returns n keys derived from the chaining key and input, as in the Noise HKDF.
+func wireGuardKDF(chainingKey, input []byte, n int) [][]byte {
+	prk := wireGuardHMAC(chainingKey, input)
+	var keys [][]byte
+	var previous []byte
+	for i := 1; i <= n; i++ {
+		previous = wireGuardHMAC(prk, previous, []byte{byte(i)})
+		keys = append(keys, previous)
+	}
+	return keys
+}
+
+// wireGuardSeal encrypts with a zero nonce, which is all the handshake ever uses.
+func wireGuardSeal(key, plaintext, additionalData []byte) []byte {
+	aead, _ := chacha20poly1305.New(key)
+	return aead.Seal(nil, make([]byte, chacha20poly1305.NonceSize), plaintext, additionalData)
+}
+
+func wireGuardOpen(key, ciphertext, additionalData []byte) ([]byte, error) {
+	aead, _ := chacha20poly1305.New(key)
+	return aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), ciphertext, additionalData)
+}
+
+// wireGuardTimestamp returns the current time in TAI64N format.
+func wireGuardTimestamp() []byte {
+	now := time.Now()
+	timestamp := make([]byte, 12)
+	binary.BigEndian.PutUint64(timestamp, wireGuardTAI64NBase+uint64(now.Unix()))
+	binary.BigEndian.PutUint32(timestamp[8:], uint32(now.Nanosecond()))
+	return timestamp
+}
+
+// wireGuardHandshake is the initiator's state for a single handshake.
+type wireGuardHandshake struct {
+	config           WireGuardConfig
+	senderIndex      uint32
+	ephemeralPrivate []byte
+	chainingKey      []byte
+	hash             []byte
+	mac1             []byte
+}
+
+// newWireGuardInitiation creates a handshake initiation message for the given server.
+func newWireGuardInitiation(config WireGuardConfig) (*wireGuardHandshake, []byte, error) {
+	hs := &wireGuardHandshake{
+		config:           config,
+		ephemeralPrivate: make([]byte, 32),
+	}
+
+	var index [4]byte
+	_, err := rand.Read(index[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	hs.senderIndex = binary.LittleEndian.Uint32(index[:])
+
+	_, err = rand.Read(hs.ephemeralPrivate)
+	if err != nil {
+		return nil, nil, err
+	}
+	ephemeralPublic, err := curve25519.X25519(hs.ephemeralPrivate, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hs.chainingKey = wireGuardHash(wireGuardConstruction)
+	hs.hash = wireGuardHash(hs.chainingKey, wireGuardIdentifier)
+	hs.hash = wireGuardHash(hs.hash, config.ServerPublicKey)
+
+	hs.chainingKey = wireGuardKDF(hs.chainingKey, ephemeralPublic, 1)[0]
+	hs.hash = wireGuardHash(hs.hash, ephemeralPublic)
+
+	sharedSecret, err := curve25519.X25519(hs.ephemeralPrivate, config.ServerPublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keys := wireGuardKDF(hs.chainingKey, sharedSecret, 2)
+	hs.chainingKey = keys[0]
+	encryptedStatic := wireGuardSeal(keys[1], config.ClientPublicKey, hs.hash)
+	hs.hash = wireGuardHash(hs.hash, encryptedStatic)
+
+	sharedSecret, err = curve25519.X25519(config.ClientPrivateKey, config.ServerPublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keys = wireGuardKDF(hs.chainingKey, sharedSecret, 2)
+	hs.chainingKey = keys[0]
+	encryptedTimestamp := wireGuardSeal(keys[1], wireGuardTimestamp(), hs.hash)
+	hs.hash = wireGuardHash(hs.hash, encryptedTimestamp)
+
+	msg := make([]byte, 0, wireGuardInitiationSize)
+	msg = append(msg, wireGuardHandshakeInitiation, 0, 0, 0)
+	msg = binary.LittleEndian.AppendUint32(msg, hs.senderIndex)
+	msg = append(msg, ephemeralPublic...)
+	msg = append(msg, encryptedStatic...)
+	msg = append(msg, encryptedTimestamp...)
+	hs.mac1 = wireGuardMAC(wireGuardHash(wireGuardLabelMAC1, config.ServerPublicKey), msg)
+	msg = append(msg, hs.mac1...)
+	msg = append(msg, make([]byte, 16)...)
+
+	return hs, msg, nil
+}
+
+// addCookie sets mac2 on the given initiation using the server's cookie reply, for when it's under load.
+func (hs *wireGuardHandshake) addCookie(initiation, reply []byte) error {
+	if len(reply) != wireGuardCookieReplySize || binary.LittleEndian.Uint32(reply[4:8]) != hs.senderIndex {
+		return errors.New("Got an invalid cookie reply")
+	}
+
+	aead, _ := chacha20poly1305.NewX(wireGuardHash(wireGuardLabelCookie, hs.config.ServerPublicKey))
+	cookie, err := aead.Open(nil, reply[8:32], reply[32:], hs.mac1)
+	if err != nil {
+		return errors.New("Could not decrypt cookie reply, check the server's public key")
+	}
+
+	copy(initiation[132:], wireGuardMAC(cookie, initiation[:132]))
+	return nil
+}
+
+// checkResponse verifies the server's handshake response.
+func (hs *wireGuardHandshake) checkResponse(response []byte) error {
+	if len(response) != wireGuardResponseSize {
+		return errors.New("Handshake response is the wrong size")
+	}
+	if binary.LittleEndian.Uint32(response[8:12]) != hs.senderIndex {
+		return errors.New("Handshake response is for a different handshake")
+	}
+	if !hmac.Equal(response[60:76], wireGuardMAC(wireGuardHash(wireGuardLabelMAC1, hs.config.ClientPublicKey), response[:60])) {
+		return errors.New("Handshake response has an invalid mac1")
+	}
+
+	ephemeralPublic := response[12:44]
+	chainingKey := wireGuardKDF(hs.chainingKey, ephemeralPublic, 1)[0]
+	hash := wireGuardHash(hs.hash, ephemeralPublic)
+
+	sharedSecret, err := curve25519.X25519(hs.ephemeralPrivate, ephemeralPublic)
+	if err != nil {
+		return err
+	}
+	chainingKey = wireGuardKDF(chainingKey, sharedSecret, 1)[0]
+
+	sharedSecret, err = curve25519.X25519(hs.config.ClientPrivateKey, ephemeralPublic)
+	if err != nil {
+		return err
+	}
+	chainingKey = wireGuardKDF(chainingKey, sharedSecret, 1)[0]
+
+	keys := wireGuardKDF(chainingKey, hs.config.PresharedKeyBytes, 3)
+	hash = wireGuardHash(hash, keys[1])
+
+	_, err = wireGuardOpen(keys[2], response[44:60], hash)
+	if err != nil {
+		return errors.New("Could not verify handshake response, check the keys")
+	}
+
+	return nil
+}
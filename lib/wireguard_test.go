@@ -0,0 +1,382 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/LondonTrustMedia/downtime_alert/lib/slo"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// testWireGuardKey returns a 32 byte key filled with the given byte.
+func testWireGuardKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+// testWireGuardConfig returns a config for a client with private key 1,1,1... connecting to a server
+// with private key 2,2,2...
+func testWireGuardConfig(t *testing.T, endpoint string, presharedKey []byte) WireGuardConfig {
+	serverPublicKey, err := curve25519.X25519(testWireGuardKey(2), curve25519.Basepoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := WireGuardConfig{
+		Endpoint:   endpoint,
+		PublicKey:  base64.StdEncoding.EncodeToString(serverPublicKey),
+		PrivateKey: base64.StdEncoding.EncodeToString(testWireGuardKey(1)),
+	}
+	if presharedKey != nil {
+		config.PresharedKey = base64.StdEncoding.EncodeToString(presharedKey)
+	}
+	err = config.parse()
+	if err != nil {
+		t.Fatalf("Could not parse config: %s", err.Error())
+	}
+	return config
+}
+
+func TestWireGuardPrimitives(t *testing.T) {
+	// BLAKE2s-256("abc"), from RFC 7693
+	expected := "508c5e8c327c14e2e1a72ba34eeb452f37458b209ed63a294d999b4c86675982"
+	if hash := hex.EncodeToString(wireGuardHash([]byte("abc"))); hash != expected {
+		t.Errorf("Hash is %s, expected %s", hash, expected)
+	}
+
+	// every handshake starts from the same chaining key and hash
+	chainingKey := wireGuardHash(wireGuardConstruction)
+	expected = "60e26daef327efc02ec335e2a025d2d016eb4206f87277f52d38d1988b78cd36"
+	if hex.EncodeToString(chainingKey) != expected {
+		t.Errorf("Initial chaining key is %x, expected %s", chainingKey, expected)
+	}
+	expected = "2211b361081ac566691243db458ad5322d9c6c662293e8b70ee19c65ba079ef3"
+	if hash := hex.EncodeToString(wireGuardHash(chainingKey, wireGuardIdentifier)); hash != expected {
+		t.Errorf("Initial hash is %s, expected %s", hash, expected)
+	}
+
+	// the KDF is HKDF, where each output is chained from the previous one
+	keys := wireGuardKDF(chainingKey, []byte("input"), 3)
+	prk := wireGuardHMAC(chainingKey, []byte("input"))
+	first := wireGuardHMAC(prk, []byte{1})
+	second := wireGuardHMAC(prk, first, []byte{2})
+	third := wireGuardHMAC(prk, second, []byte{3})
+	if len(keys) != 3 || !bytes.Equal(keys[0], first) || !bytes.Equal(keys[1], second) || !bytes.Equal(keys[2], third) {
+		t.Errorf("KDF returned %x, expected %x %x %x", keys, first, second, third)
+	}
+}
+
+// testWireGuardResponder is the server's state for a handshake, written from the WireGuard paper
+// rather than shared with the initiator's code.
+type testWireGuardResponder struct {
+	privateKey   []byte
+	publicKey    []byte
+	presharedKey []byte
+
+	chainingKey     []byte
+	hash            []byte
+	senderIndex     uint32
+	ephemeralPublic []byte
+	peerStatic      []byte
+	timestamp       []byte
+}
+
+func newTestWireGuardResponder(presharedKey []byte) *testWireGuardResponder {
+	publicKey, _ := curve25519.X25519(testWireGuardKey(2), curve25519.Basepoint)
+	if presharedKey == nil {
+		presharedKey = make([]byte, 32)
+	}
+	return &testWireGuardResponder{
+		privateKey:   testWireGuardKey(2),
+		publicKey:    publicKey,
+		presharedKey: presharedKey,
+	}
+}
+
+// consumeInitiation checks and decrypts the given handshake initiation.
+func (r *testWireGuardResponder) consumeInitiation(msg []byte) error {
+	if len(msg) != wireGuardInitiationSize || msg[0] != wireGuardHandshakeInitiation {
+		return errors.New("Not a handshake initiation")
+	}
+	if !hmac.Equal(msg[116:132], wireGuardMAC(wireGuardHash(wireGuardLabelMAC1, r.publicKey), msg[:116])) {
+		return errors.New("Invalid mac1")
+	}
+	r.senderIndex = binary.LittleEndian.Uint32(msg[4:8])
+	r.ephemeralPublic = msg[8:40]
+
+	r.chainingKey = wireGuardHash(wireGuardConstruction)
+	r.hash = wireGuardHash(wireGuardHash(r.chainingKey, wireGuardIdentifier), r.publicKey)
+	r.chainingKey = wireGuardKDF(r.chainingKey, r.ephemeralPublic, 1)[0]
+	r.hash = wireGuardHash(r.hash, r.ephemeralPublic)
+
+	sharedSecret, _ := curve25519.X25519(r.privateKey, r.ephemeralPublic)
+	keys := wireGuardKDF(r.chainingKey, sharedSecret, 2)
+	r.chainingKey = keys[0]
+	peerStatic, err := wireGuardOpen(keys[1], msg[40:88], r.hash)
+	if err != nil {
+		return errors.New("Could not decrypt static key")
+	}
+	r.peerStatic = peerStatic
+	r.hash = wireGuardHash(r.hash, msg[40:88])
+
+	sharedSecret, _ = curve25519.X25519(r.privateKey, r.peerStatic)
+	keys = wireGuardKDF(r.chainingKey, sharedSecret, 2)
+	r.chainingKey = keys[0]
+	timestamp, err := wireGuardOpen(keys[1], msg[88:116], r.hash)
+	if err != nil {
+		return errors.New("Could not decrypt timestamp")
+	}
+	r.timestamp = timestamp
+	r.hash = wireGuardHash(r.hash, msg[88:116])
+	return nil
+}
+
+// createResponse returns the response to the initiation we consumed.
+func (r *testWireGuardResponder) createResponse() []byte {
+	ephemeralPrivate := testWireGuardKey(3)
+	ephemeralPublic, _ := curve25519.X25519(ephemeralPrivate, curve25519.Basepoint)
+
+	msg := []byte{wireGuardHandshakeResponse, 0, 0, 0}
+	msg = binary.LittleEndian.AppendUint32(msg, 0x12345678)
+	msg = binary.LittleEndian.AppendUint32(msg, r.senderIndex)
+	msg = append(msg, ephemeralPublic...)
+
+	chainingKey := wireGuardKDF(r.chainingKey, ephemeralPublic, 1)[0]
+	hash := wireGuardHash(r.hash, ephemeralPublic)
+	sharedSecret, _ := curve25519.X25519(ephemeralPrivate, r.ephemeralPublic)
+	chainingKey = wireGuardKDF(chainingKey, sharedSecret, 1)[0]
+	sharedSecret, _ = curve25519.X25519(ephemeralPrivate, r.peerStatic)
+	chainingKey = wireGuardKDF(chainingKey, sharedSecret, 1)[0]
+	keys := wireGuardKDF(chainingKey, r.presharedKey, 3)
+	hash = wireGuardHash(hash, keys[1])
+	msg = append(msg, wireGuardSeal(keys[2], nil, hash)...)
+
+	msg = append(msg, wireGuardMAC(wireGuardHash(wireGuardLabelMAC1, r.peerStatic), msg)...)
+	return append(msg, make([]byte, 16)...)
+}
+
+// createCookieReply returns a cookie reply to the given initiation.
+func (r *testWireGuardResponder) createCookieReply(initiation, cookie []byte) []byte {
+	msg := []byte{wireGuardCookieReply, 0, 0, 0}
+	msg = append(msg, initiation[4:8]...)
+	nonce := bytes.Repeat([]byte{4}, chacha20poly1305.NonceSizeX)
+	msg = append(msg, nonce...)
+	aead, _ := chacha20poly1305.NewX(wireGuardHash(wireGuardLabelCookie, r.publicKey))
+	return aead.Seal(msg, nonce, cookie, initiation[116:132])
+}
+
+func TestWireGuardInitiation(t *testing.T) {
+	config := testWireGuardConfig(t, "127.0.0.1:51820", nil)
+	hs, initiation, err := newWireGuardInitiation(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(initiation) != wireGuardInitiationSize {
+		t.Fatalf("Initiation is %d bytes, expected %d", len(initiation), wireGuardInitiationSize)
+	}
+	if !bytes.Equal(initiation[:4], []byte{wireGuardHandshakeInitiation, 0, 0, 0}) {
+		t.Errorf("Initiation starts with %x", initiation[:4])
+	}
+	if binary.LittleEndian.Uint32(initiation[4:8]) != hs.senderIndex {
+		t.Errorf("Initiation has sender index %x, expected %x", initiation[4:8], hs.senderIndex)
+	}
+	if !bytes.Equal(initiation[132:], make([]byte, 16)) {
+		t.Errorf("Initiation has mac2 %x without a cookie", initiation[132:])
+	}
+
+	responder := newTestWireGuardResponder(nil)
+	err = responder.consumeInitiation(initiation)
+	if err != nil {
+		t.Fatalf("Server could not consume initiation: %s", err.Error())
+	}
+	if !bytes.Equal(responder.peerStatic, config.ClientPublicKey) {
+		t.Errorf("Initiation has static key %x, expected %x", responder.peerStatic, config.ClientPublicKey)
+	}
+	seconds := binary.BigEndian.Uint64(responder.timestamp) - wireGuardTAI64NBase
+	if age := time.Since(time.Unix(int64(seconds), 0)); age < -time.Second || time.Minute < age {
+		t.Errorf("Initiation timestamp is %v old", age)
+	}
+	if !bytes.Equal(responder.hash, hs.hash) || !bytes.Equal(responder.chainingKey, hs.chainingKey) {
+		t.Error("Server and client disagree on the handshake state")
+	}
+
+	// a server with a different key can't read it
+	otherConfig := config
+	otherConfig.ServerPublicKey, _ = curve25519.X25519(testWireGuardKey(9), curve25519.Basepoint)
+	_, initiation, err = newWireGuardInitiation(otherConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if responder.consumeInitiation(initiation) == nil {
+		t.Error("Server consumed an initiation made for a different key")
+	}
+}
+
+func TestWireGuardCheckResponse(t *testing.T) {
+	presharedKey := testWireGuardKey(5)
+
+	for _, test := range []struct {
+		name   string
+		psk    []byte
+		offset int
+		// fixMAC1 recalculates mac1 after tampering, so we get as far as the handshake itself
+		fixMAC1 bool
+		valid   bool
+	}{
+		{"valid", nil, -1, false, true},
+		{"valid with preshared key", presharedKey, -1, false, true},
+		{"wrong receiver index", nil, 8, false, false},
+		{"tampered mac1", nil, 60, false, false},
+		{"tampered ephemeral key", nil, 12, true, false},
+		{"tampered empty payload", nil, 44, true, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			config := testWireGuardConfig(t, "127.0.0.1:51820", test.psk)
+			hs, initiation, err := newWireGuardInitiation(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			responder := newTestWireGuardResponder(test.psk)
+			err = responder.consumeInitiation(initiation)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			response := responder.createResponse()
+			if len(response) != wireGuardResponseSize {
+				t.Fatalf("Response is %d bytes, expected %d", len(response), wireGuardResponseSize)
+			}
+			if test.offset >= 0 {
+				response[test.offset] ^= 1
+			}
+			if test.fixMAC1 {
+				copy(response[60:76], wireGuardMAC(wireGuardHash(wireGuardLabelMAC1, config.ClientPublicKey), response[:60]))
+			}
+
+			err = hs.checkResponse(response)
+			if test.valid && err != nil {
+				t.Errorf("Valid response was rejected: %s", err.Error())
+			} else if !test.valid && err == nil {
+				t.Error("Invalid response was accepted")
+			}
+		})
+	}
+
+	// the preshared key has to match too
+	config := testWireGuardConfig(t, "127.0.0.1:51820", presharedKey)
+	hs, initiation, _ := newWireGuardInitiation(config)
+	responder := newTestWireGuardResponder(nil)
+	responder.consumeInitiation(initiation)
+	if hs.checkResponse(responder.createResponse()) == nil {
+		t.Error("Response with the wrong preshared key was accepted")
+	}
+	if hs.checkResponse(responder.createResponse()[:60]) == nil {
+		t.Error("Truncated response was accepted")
+	}
+}
+
+func TestWireGuardCookieReply(t *testing.T) {
+	config := testWireGuardConfig(t, "127.0.0.1:51820", nil)
+	hs, initiation, err := newWireGuardInitiation(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder := newTestWireGuardResponder(nil)
+	cookie := bytes.Repeat([]byte{6}, 16)
+
+	// a reply for a different handshake, or encrypted with a different key, is ignored
+	reply := responder.createCookieReply(initiation, cookie)
+	reply[4] ^= 1
+	if hs.addCookie(initiation, reply) == nil {
+		t.Error("Cookie reply for a different handshake was accepted")
+	}
+	reply = responder.createCookieReply(initiation, cookie)
+	reply[len(reply)-1] ^= 1
+	if hs.addCookie(initiation, reply) == nil {
+		t.Error("Tampered cookie reply was accepted")
+	}
+	if !bytes.Equal(initiation[132:], make([]byte, 16)) {
+		t.Error("mac2 was set from an invalid cookie reply")
+	}
+
+	err = hs.addCookie(initiation, responder.createCookieReply(initiation, cookie))
+	if err != nil {
+		t.Fatalf("Could not add cookie: %s", err.Error())
+	}
+	if !bytes.Equal(initiation[132:], wireGuardMAC(cookie, initiation[:132])) {
+		t.Errorf("mac2 is %x, expected a MAC of the initiation using the cookie", initiation[132:])
+	}
+
+	// the rest of the initiation is unchanged, so the server can still consume it
+	err = responder.consumeInitiation(initiation)
+	if err != nil {
+		t.Errorf("Server could not consume initiation with a cookie: %s", err.Error())
+	}
+}
+
+// serveTestWireGuard answers handshakes on the given connection, sending a cookie reply to the first
+// initiation if underLoad is set.
+func serveTestWireGuard(conn net.PacketConn, underLoad bool) {
+	cookie := bytes.Repeat([]byte{6}, 16)
+	buf := make([]byte, 256)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		initiation := buf[:n]
+		responder := newTestWireGuardResponder(nil)
+		if responder.consumeInitiation(initiation) != nil {
+			continue
+		}
+		if underLoad && !hmac.Equal(initiation[132:], wireGuardMAC(cookie, initiation[:132])) {
+			conn.WriteTo(responder.createCookieReply(initiation, cookie), addr)
+			continue
+		}
+		conn.WriteTo(responder.createResponse(), addr)
+	}
+}
+
+func TestCheckWireGuard(t *testing.T) {
+	for _, underLoad := range []bool{false, true} {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go serveTestWireGuard(conn, underLoad)
+
+		tracker := slo.NewPingTracker()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err = CheckWireGuard(ctx, tracker, testWireGuardConfig(t, conn.LocalAddr().String(), nil))
+		cancel()
+		conn.Close()
+		if err != nil {
+			t.Errorf("Handshake failed with underLoad=%v: %s", underLoad, err.Error())
+		}
+		if tracker.SuccessfulTestsPerformed() != 1 {
+			t.Errorf("Tracker has %d successful handshakes, expected 1", tracker.SuccessfulTestsPerformed())
+		}
+	}
+
+	// a server that never responds times out
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	tracker := slo.NewPingTracker()
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	err = CheckWireGuard(ctx, tracker, testWireGuardConfig(t, conn.LocalAddr().String(), nil))
+	if !IsTimeout(err) || tracker.TimeoutsPerformed() != 1 {
+		t.Errorf("Expected a recorded timeout, got %v", err)
+	}
+}